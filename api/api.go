@@ -1,13 +1,18 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"goenc/encoder"
 	"goenc/storage"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -23,10 +28,18 @@ func APIRouter(inputRouter chi.Router) {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			//set cors headers
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-KEY")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-KEY, Idempotency-Key, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Idempotent-Replayed, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length")
 
 			if r.Method == "OPTIONS" {
+				//advertise tus support
+				w.Header().Set("Tus-Resumable", tusVersion)
+				w.Header().Set("Tus-Version", tusVersion)
+				w.Header().Set("Tus-Extension", tusExtensions)
+				if maxSize := tusMaxSize(); maxSize > 0 {
+					w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+				}
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
@@ -58,14 +71,9 @@ func APIRouter(inputRouter chi.Router) {
 	})
 
 	r.Get("/profiles", func(w http.ResponseWriter, r *http.Request) {
-		profiles := []string{}
-		for _, sm := range encoder.SizeMapping {
-			profiles = append(profiles, sm.Label)
-		}
-
 		ReplyWithJSON(w, http.StatusOK, map[string]any{
 			"success": "true",
-			"data":    profiles,
+			"data":    encoder.Profiles(),
 		})
 	})
 
@@ -178,18 +186,194 @@ func APIRouter(inputRouter chi.Router) {
 	})
 
 	r.Get("/queue", func(w http.ResponseWriter, r *http.Request) {
-		queue := encoder.GetQueue()
-		w.Header().Set("Content-Type", "application/json")
+		options := encoder.QueueListOptions{Cursor: r.URL.Query().Get("cursor")}
+		if status := r.URL.Query().Get("status"); status != "" {
+			for _, name := range strings.Split(status, ",") {
+				status := encoder.Status(strings.TrimSpace(name))
+				if !encoder.ValidStatus(status) {
+					ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid status " + string(status)})
+					return
+				}
+				// a status listed twice would list its items twice
+				if !slices.Contains(options.Statuses, status) {
+					options.Statuses = append(options.Statuses, status)
+				}
+			}
+		}
+		switch r.URL.Query().Get("order") {
+		case "", "asc":
+		case "desc":
+			options.Descending = true
+		default:
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "order must be asc or desc"})
+			return
+		}
+		if limit := r.URL.Query().Get("limit"); limit != "" {
+			parsed, err := strconv.Atoi(limit)
+			if err != nil || parsed < 1 || parsed > encoder.MaxListLimit {
+				ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(encoder.MaxListLimit)})
+				return
+			}
+			options.Limit = parsed
+		}
 
-		if queue == nil {
-			queue = []encoder.QueueItem{}
+		list, err := encoder.ListQueue(options)
+		if errors.Is(err, encoder.ErrInvalidCursor) {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to list queue", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list queue"})
+			return
 		}
 
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success":     "true",
+			"data":        list.Items,
+			"total":       list.Total,
+			"next_cursor": list.NextCursor,
+		})
+	})
+
+	r.Get("/queue/{id}", func(w http.ResponseWriter, r *http.Request) {
+		item, err := encoder.GetQueueItem(r.Context(), chi.URLParam(r, "id"))
+		if errors.Is(err, encoder.ErrJobNotFound) {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to get queue item", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to get queue item"})
+			return
+		}
 		ReplyWithJSON(w, http.StatusOK, map[string]any{
 			"success": "true",
-			"data":    queue,
+			"data":    item,
 		})
+	})
+
+	r.Get("/queue/events", queueEvents)
+	r.Get("/queue/{id}/events", jobEvents)
+
+	r.Post("/queue/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		item, err := encoder.CancelJob(chi.URLParam(r, "id"))
+		switch {
+		case errors.Is(err, encoder.ErrJobNotFound):
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, encoder.ErrJobNotCancelable):
+			ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			slog.Error("Failed to cancel job", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to cancel job"})
+			return
+		}
 
+		//processing jobs are stopped by their worker
+		code := http.StatusOK
+		if item.Status == encoder.Processing {
+			code = http.StatusAccepted
+		}
+		ReplyWithJSON(w, code, map[string]any{
+			"success": "true",
+			"data":    item,
+		})
+	})
+
+	r.Get("/queue/dead", func(w http.ResponseWriter, r *http.Request) {
+		dead, err := encoder.GetDeadJobs()
+		if err != nil {
+			slog.Error("Failed to list dead jobs", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list dead jobs"})
+			return
+		}
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    dead,
+		})
+	})
+
+	r.Post("/queue/dead/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		item, err := encoder.RetryDeadJob(chi.URLParam(r, "id"))
+		switch {
+		case errors.Is(err, encoder.ErrJobNotFound):
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "dead job does not exist"})
+			return
+		case errors.Is(err, encoder.ErrDeadJobChanged), errors.Is(err, encoder.ErrJobActive):
+			ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			slog.Error("Failed to retry dead job", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retry job"})
+			return
+		}
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    item,
+		})
+	})
+
+	r.Get("/webhooks/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		deliveries, err := encoder.GetWebhookDeliveries()
+		if err != nil {
+			slog.Error("Failed to list webhook deliveries", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list webhook deliveries"})
+			return
+		}
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    deliveries,
+		})
+	})
+
+	r.Get("/history", func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := 0, encoder.DefaultListLimit
+		if value := r.URL.Query().Get("offset"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "offset must be 0 or more"})
+				return
+			}
+			offset = parsed
+		}
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > encoder.MaxListLimit {
+				ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(encoder.MaxListLimit)})
+				return
+			}
+			limit = parsed
+		}
+		history, total, err := encoder.GetHistory(offset, limit)
+		if err != nil {
+			slog.Error("Failed to list history", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list history"})
+			return
+		}
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    history,
+			"total":   total,
+		})
+	})
+
+	r.Get("/history/{id}", func(w http.ResponseWriter, r *http.Request) {
+		item, err := encoder.GetHistoryItem(r.Context(), chi.URLParam(r, "id"))
+		if errors.Is(err, encoder.ErrJobNotFound) {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "job is not in the history"})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to get history item", "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to get history item"})
+			return
+		}
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    item,
+		})
 	})
 
 	r.Post("/queue/recover", func(w http.ResponseWriter, r *http.Request) {
@@ -203,67 +387,286 @@ func APIRouter(inputRouter chi.Router) {
 	})
 
 	r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+		//resumable uploads are created through the same endpoint
+		if r.Header.Get("Tus-Resumable") != "" {
+			createTusUpload(w, r)
+			return
+		}
+
 		//get file id from query
 		id := r.URL.Query().Get("id")
 		if id == "" {
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "id is required"})
 			return
 		}
-
-		valid := storage.FileExists(id + "/meta.json")
-		if valid {
-			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "id already exists"})
+		// the id is reserved until the job is queued, a retry sent while the file is still streaming would overwrite the input.
+		// The checks run after the id is reserved, so they see the job a request before queued.
+		ctx := context.Background()
+		lock := lockUpload(ctx, w, id)
+		if lock == nil {
 			return
 		}
-
-		//check if id only contains alphanumeric characters
-		allowedChars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-		for _, c := range id {
-			if !strings.Contains(allowedChars, string(c)) {
-				ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "ID may only contain alphanumeric characters"})
-				return
-			}
+		defer lock.release()
+		if replayIdempotent(w, r, id) {
+			return
+		}
+		if !checkNewId(w, id) {
+			return
 		}
 
-		profiles := r.URL.Query().Get("profiles")
-		if profiles == "" {
-			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "profiles is required"})
+		profiles, ok := resolveProfiles(w, r.URL.Query().Get("profiles"), r.URL.Query().Get("ladder"))
+		if !ok {
+			return
+		}
+		options, ok := jobOptions(w, r.URL.Query().Get("queue"), r.URL.Query().Get("priority"), r.URL.Query().Get("callback_url"))
+		if !ok {
 			return
 		}
+		options.IdempotencyKey = r.Header.Get("Idempotency-Key")
 
-		// Parse the multipart form with a reasonable maxMemory (e.g., 32MB)
-		if err := r.ParseMultipartForm(32 << 20); err != nil {
-			slog.Error("Failed to parse multipart form", "error", err)
+		// Stream the file part straight into storage instead of buffering the form
+		reader, err := r.MultipartReader()
+		if err != nil {
+			slog.Error("Failed to read multipart form", "error", err)
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to parse multipart form"})
 			return
 		}
 
-		file, _, err := r.FormFile("file")
-		if err != nil {
+		var file *multipart.Part
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				slog.Error("Failed to read multipart form", "error", err)
+				ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to parse multipart form"})
+				return
+			}
+			if part.FormName() == "file" {
+				file = part
+				break
+			}
+			part.Close()
+		}
+		if file == nil {
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Could not find file"})
 			return
 		}
 		defer file.Close()
 
 		//write file to tmp
-		fileBytes, err := io.ReadAll(file)
+		writer, err := storage.Create("tmp/" + id + "/" + "input")
 		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to store file"})
+			return
+		}
+		if _, err := io.Copy(writer, lock.reader(file)); err != nil {
+			storage.Abort(writer, err)
+			if errors.Is(err, errUploadLockLost) {
+				ReplyWithJSON(w, http.StatusLocked, map[string]string{"error": "upload is in use"})
+				return
+			}
 			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to read file"})
 			return
 		}
-		storage.FilePut("tmp/"+id+"/"+"input", fileBytes)
+		if err := writer.Close(); err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to store file"})
+			return
+		}
 
-		id = encoder.AddFileToQueue("tmp/"+id+"/"+"input", id, profiles)
+		queued, err := encoder.AddFileToQueue("tmp/"+id+"/"+"input", id, profiles, options)
+		if err == nil && queued != id {
+			// no job uses the file
+			storage.FileDelete("tmp/" + id + "/" + "input")
+		}
+		replyQueued(w, id, queued, err)
+	})
 
-		ReplyWithJSON(w, http.StatusOK, map[string]string{"id": id})
+	r.Post("/ingest", func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Id          string `json:"id"`
+			URL         string `json:"url"`
+			Profiles    string `json:"profiles"`
+			Ladder      string `json:"ladder"`
+			Queue       string `json:"queue"`
+			Priority    *int   `json:"priority"`
+			CallbackURL string `json:"callback_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+
+		if replayIdempotent(w, r, data.Id) {
+			return
+		}
+		if !checkNewId(w, data.Id) {
+			return
+		}
+
+		if data.URL == "" {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "url is required"})
+			return
+		}
+		source, err := url.Parse(data.URL)
+		if err != nil || source.Host == "" || (source.Scheme != "http" && source.Scheme != "https" && source.Scheme != "s3") {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "url must be an http(s) or s3://bucket/key url"})
+			return
+		}
+
+		profiles, ok := resolveProfiles(w, data.Profiles, data.Ladder)
+		if !ok {
+			return
+		}
+		priority := ""
+		if data.Priority != nil {
+			priority = strconv.Itoa(*data.Priority)
+		}
+		options, ok := jobOptions(w, data.Queue, priority, data.CallbackURL)
+		if !ok {
+			return
+		}
+		options.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+		//the worker downloads the source itself
+		queued, err := encoder.AddFileToQueue(data.URL, data.Id, profiles, options)
+		replyQueued(w, data.Id, queued, err)
 	})
 
+	tusRouter(r)
+	laddersRouter(r)
 	videosRouter(r)
 
 	inputRouter.Mount("/api", r)
 
 }
 
+// replayIdempotent replies with the job an earlier request with the same Idempotency-Key queued and returns true,
+// so a retried submission doesn't queue the video twice
+func replayIdempotent(w http.ResponseWriter, r *http.Request, id string) bool {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return false
+	}
+	if len(key) > encoder.MaxIdempotencyKeyLength {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key may be at most " + strconv.Itoa(encoder.MaxIdempotencyKeyLength) + " characters"})
+		return true
+	}
+	existing, err := encoder.IdempotentJob(r.Context(), key)
+	if err != nil {
+		slog.Error("Failed to look up idempotency key", "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to look up Idempotency-Key"})
+		return true
+	}
+	if existing == "" {
+		return false
+	}
+	if existing != id {
+		ReplyWithJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Idempotency-Key was already used for job " + existing})
+		return true
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	ReplyWithJSON(w, http.StatusOK, map[string]string{"id": existing})
+	return true
+}
+
+// errIdempotencyKeyUsed is returned when the idempotency key of a job was used for a job with another id meanwhile
+var errIdempotencyKeyUsed = errors.New("Idempotency-Key was already used for job")
+
+// replyQueued replies to a request that queued the job id, queued and err are the results of AddFileToQueue
+func replyQueued(w http.ResponseWriter, id string, queued string, err error) {
+	switch {
+	case errors.Is(err, encoder.ErrJobActive):
+		ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		slog.Error("Failed to queue file", "id", id, "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to queue file"})
+	case queued != id:
+		// another request with the same idempotency key queued its job after this request checked the key
+		ReplyWithJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": errIdempotencyKeyUsed.Error() + " " + queued})
+	default:
+		ReplyWithJSON(w, http.StatusOK, map[string]string{"id": id})
+	}
+}
+
+// ids that can't be used for a video
+var reservedIds = []string{"dead", "events"}
+
+// checkNewId replies with an error and returns false if id can't be used for a new video
+func checkNewId(w http.ResponseWriter, id string) bool {
+	if id == "" {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "id is required"})
+		return false
+	}
+
+	valid := storage.FileExists(id + "/meta.json")
+	if valid {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "id already exists"})
+		return false
+	}
+
+	//a job still using the id would have its input overwritten
+	active, err := encoder.JobActive(context.Background(), id)
+	if err != nil {
+		slog.Error("Failed to check for an active job", "id", id, "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to check id"})
+		return false
+	}
+	if active {
+		ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": encoder.ErrJobActive.Error()})
+		return false
+	}
+
+	//check if id only contains alphanumeric characters
+	allowedChars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	for _, c := range id {
+		if !strings.Contains(allowedChars, string(c)) {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "ID may only contain alphanumeric characters"})
+			return false
+		}
+	}
+
+	//these are routes under /queue, a job with the id couldn't be fetched
+	if slices.Contains(reservedIds, id) {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "id is reserved"})
+		return false
+	}
+	return true
+}
+
+// resolveProfiles replies with an error and returns false if neither a valid profile list nor a valid ladder was passed
+func resolveProfiles(w http.ResponseWriter, profiles string, ladder string) (string, bool) {
+	resolved, err := encoder.ResolveProfiles(profiles, ladder)
+	if err == encoder.ErrLadderNotFound {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "ladder does not exist"})
+		return "", false
+	}
+	if err != nil {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return "", false
+	}
+	return resolved, true
+}
+
+// jobOptions replies with an error and returns false if the queue, priority or callback url of a new job are invalid
+func jobOptions(w http.ResponseWriter, queue string, priority string, callbackURL string) (encoder.JobOptions, bool) {
+	options := encoder.JobOptions{Queue: queue, Priority: encoder.DefaultPriority, CallbackURL: callbackURL}
+	if priority != "" {
+		parsed, err := strconv.Atoi(priority)
+		if err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "priority must be a number"})
+			return options, false
+		}
+		options.Priority = parsed
+	}
+	if err := options.Validate(); err != nil {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return options, false
+	}
+	return options, true
+}
+
 func IdValid(id string) bool {
 	allowedChars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	for _, c := range id {
@@ -339,6 +742,14 @@ func videosRouter(inputRouter chi.Router) {
 			return
 		}
 
+		//read the callback url of the video before its meta is gone
+		var meta struct {
+			CallbackURL string `json:"callback_url"`
+		}
+		if metaFile, err := storage.FileGet(id+"/meta.json", true); err == nil && metaFile.Data != nil {
+			json.Unmarshal(*metaFile.Data, &meta)
+		}
+
 		//we delete meta first to prevent multiple delete options as much as possible
 		err := storage.FileDelete(id + "/meta.json")
 		if err != nil {
@@ -351,6 +762,7 @@ func videosRouter(inputRouter chi.Router) {
 			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete directory"})
 			return
 		}
+		encoder.NotifyDeleted(id, meta.CallbackURL)
 
 		w.WriteHeader(http.StatusNoContent)
 	})
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"goenc/encoder"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// how often a comment is sent on idle event streams so proxies don't close them
+const eventsKeepAlive = 15 * time.Second
+
+// queueEvents streams the changes of all queue items as server-sent events
+func queueEvents(w http.ResponseWriter, r *http.Request) {
+	events, err := encoder.SubscribeQueueEvents(r.Context(), "")
+	if err != nil {
+		slog.Error("Failed to subscribe to queue events", "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to subscribe to queue events"})
+		return
+	}
+	streamEvents(w, r, events, nil)
+}
+
+// jobEvents streams the changes of one queue item as server-sent events, starting with its current state.
+// The stream ends once the job is finished.
+func jobEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	// subscribe before reading the item so no change in between is missed
+	events, err := encoder.SubscribeQueueEvents(r.Context(), id)
+	if err != nil {
+		slog.Error("Failed to subscribe to queue events", "id", id, "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to subscribe to queue events"})
+		return
+	}
+	item, err := encoder.GetQueueItem(r.Context(), id)
+	if errors.Is(err, encoder.ErrJobNotFound) {
+		ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to get queue item", "id", id, "error", err)
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to get queue item"})
+		return
+	}
+	current := encoder.QueueEvent{Type: encoder.QueueEventUpdate, Item: item}
+	streamEvents(w, r, events, &current)
+}
+
+func finished(event encoder.QueueEvent) bool {
+	switch event.Item.Status {
+	case encoder.Done, encoder.Fail, encoder.Cancelled:
+		return true
+	}
+	return event.Type == encoder.QueueEventRemoved
+}
+
+// streamEvents writes events to the client until it disconnects. With first set, only the events of that job
+// are expected and the stream ends once the job is finished.
+func streamEvents(w http.ResponseWriter, r *http.Request, events <-chan encoder.QueueEvent, first *encoder.QueueEvent) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	//stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event encoder.QueueEvent) bool {
+		data, err := json.Marshal(event.Item)
+		if err != nil {
+			return true
+		}
+		if _, err := w.Write([]byte("event: " + event.Type + "\ndata: " + string(data) + "\n\n")); err != nil {
+			return false
+		}
+		return controller.Flush() == nil
+	}
+
+	if first != nil {
+		if !send(*first) || finished(*first) {
+			return
+		}
+	}
+	if controller.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if !send(event) {
+				return
+			}
+			if first != nil && finished(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			if controller.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"goenc/encoder"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func laddersRouter(inputRouter chi.Router) {
+	r := chi.NewRouter()
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		ladders, err := encoder.GetLadders()
+		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to get ladders"})
+			return
+		}
+
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    ladders,
+		})
+	})
+
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		var ladder encoder.Ladder
+		if err := json.NewDecoder(r.Body).Decode(&ladder); err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+
+		err := encoder.CreateLadder(ladder)
+		if err == encoder.ErrLadderExists {
+			ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": "ladder already exists"})
+			return
+		}
+		if err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		ReplyWithJSON(w, http.StatusCreated, map[string]any{
+			"success": "true",
+			"data":    ladder,
+		})
+	})
+
+	r.Get("/{name}", func(w http.ResponseWriter, r *http.Request) {
+		ladder, err := encoder.GetLadder(chi.URLParam(r, "name"))
+		if err == encoder.ErrLadderNotFound {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "ladder does not exist"})
+			return
+		}
+		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to get ladder"})
+			return
+		}
+
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    ladder,
+		})
+	})
+
+	r.Put("/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var ladder encoder.Ladder
+		if err := json.NewDecoder(r.Body).Decode(&ladder); err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		ladder.Name = chi.URLParam(r, "name")
+
+		if err := encoder.SaveLadder(ladder); err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		ReplyWithJSON(w, http.StatusOK, map[string]any{
+			"success": "true",
+			"data":    ladder,
+		})
+	})
+
+	r.Delete("/{name}", func(w http.ResponseWriter, r *http.Request) {
+		err := encoder.DeleteLadder(chi.URLParam(r, "name"))
+		if err == encoder.ErrLadderNotFound {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "ladder does not exist"})
+			return
+		}
+		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete ladder"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	inputRouter.Mount("/ladders", r)
+}
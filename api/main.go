@@ -2,7 +2,6 @@ package api
 
 import (
 	"encoding/json"
-	"goenc/encoder"
 	"net/http"
 )
 
@@ -11,12 +10,3 @@ func ReplyWithJSON(w http.ResponseWriter, code int, data any) {
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(data)
 }
-
-func resValid(res string) bool {
-	for _, sm := range encoder.SizeMapping {
-		if sm.Label == res {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,509 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goenc/encoder"
+	"goenc/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
+)
+
+// tus 1.0 resumable uploads, see https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,termination"
+
+// unfinished uploads are forgotten after this long without activity
+const tusUploadExpiry = 24 * time.Hour
+
+// Unfinished uploads are tracked in the uploads sorted set, scored by their last activity in unix milliseconds.
+// The sweeper removes the staged chunks of the uploads that expired.
+const (
+	tusUploadsKey  = "uploads"
+	tusSweepPeriod = time.Hour
+)
+
+type tusUpload struct {
+	Id       string             `json:"id"`
+	Profiles string             `json:"profiles"`
+	Options  encoder.JobOptions `json:"options"`
+	Length   int64              `json:"length"`
+	Offset   int64              `json:"offset"`
+	Parts    []int64            `json:"parts"` // offsets of the staged chunks, in order
+}
+
+func tusMaxSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("TUS_MAX_SIZE"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func tusPartPath(id string, offset int64) string {
+	return fmt.Sprintf("tmp/%s/parts/%020d", id, offset)
+}
+
+func getTusUpload(ctx context.Context, id string) (tusUpload, error) {
+	var upload tusUpload
+	data, err := encoder.Redis.Get(ctx, "upload:"+id).Result()
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal([]byte(data), &upload)
+	return upload, err
+}
+
+func saveTusUpload(ctx context.Context, upload tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	_, err = encoder.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "upload:"+upload.Id, string(data), tusUploadExpiry)
+		trackTusUpload(ctx, pipe, upload.Id)
+		return nil
+	})
+	return err
+}
+
+func trackTusUpload(ctx context.Context, pipe redis.Cmdable, id string) {
+	pipe.ZAdd(ctx, tusUploadsKey, &redis.Z{Score: float64(time.Now().UnixMilli()), Member: id})
+}
+
+// removeTusUpload forgets a finished or terminated upload
+func removeTusUpload(ctx context.Context, id string) {
+	_, err := encoder.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, "upload:"+id)
+		pipe.ZRem(ctx, tusUploadsKey, id)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to remove upload", "id", id, "error", err)
+	}
+}
+
+// sweepTusUploads removes the staged chunks of the uploads that expired without being finished
+func sweepTusUploads() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-tusUploadExpiry)
+	ids, err := encoder.Redis.ZRangeByScore(ctx, tusUploadsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(cutoff.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		slog.Error("Failed to list uploads", "error", err)
+		return
+	}
+	for _, id := range ids {
+		// an upload created again under the id since is tracked with a new score
+		exists, err := encoder.Redis.Exists(ctx, "upload:"+id).Result()
+		if err != nil || exists > 0 {
+			continue
+		}
+		if err := storage.DirectoryDelete("tmp/" + id + "/parts"); err != nil {
+			slog.Warn("Failed to remove chunks of expired upload", "id", id, "error", err)
+			continue
+		}
+		encoder.Redis.ZRem(ctx, tusUploadsKey, id)
+		slog.Info("Removed chunks of expired upload", "id", id)
+	}
+}
+
+// StartTusSweeper periodically removes the staged chunks of abandoned uploads
+func StartTusSweeper() {
+	for {
+		sweepTusUploads()
+		time.Sleep(tusSweepPeriod)
+	}
+}
+
+// upload:{id}:lock is held while a request writes the chunks or the input of the id, by tus and by plain uploads.
+// It is refreshed while the request streams, so it outlasts long uploads and expires when the process dies.
+const (
+	uploadLockTTL     = 30 * time.Second
+	uploadLockRefresh = 10 * time.Second
+)
+
+var errUploadLockLost = errors.New("lost the upload lock")
+
+type uploadLock struct {
+	id     string
+	lock   *redislock.Lock
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// lockUpload takes the upload lock of an id, replying with an error and returning nil when it is held by another request
+func lockUpload(ctx context.Context, w http.ResponseWriter, id string) *uploadLock {
+	lock, err := redislock.New(encoder.Redis).Obtain(ctx, "upload:"+id+":lock", uploadLockTTL, nil)
+	if err == redislock.ErrNotObtained {
+		ReplyWithJSON(w, http.StatusLocked, map[string]string{"error": "upload is in use"})
+		return nil
+	}
+	if err != nil {
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to lock upload"})
+		return nil
+	}
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	l := &uploadLock{id: id, lock: lock, ctx: lockCtx, cancel: cancel, done: make(chan struct{})}
+	go l.refresh()
+	return l
+}
+
+func (l *uploadLock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(uploadLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.lock.Refresh(l.ctx, uploadLockTTL, nil)
+		if err == redislock.ErrNotObtained {
+			slog.Error("Upload lock lost, stopping", "id", l.id)
+			l.cancel(errUploadLockLost)
+			return
+		}
+		if err != nil && l.ctx.Err() == nil {
+			// the lock is only lost once it expires, try again on the next tick
+			slog.Warn("Failed to refresh upload lock", "id", l.id, "error", err)
+		}
+	}
+}
+
+// reader stops reading with errUploadLockLost once the lock is lost, so another request holding it now writes alone
+func (l *uploadLock) reader(r io.Reader) io.Reader {
+	return lockedReader{l: l, r: r}
+}
+
+type lockedReader struct {
+	l *uploadLock
+	r io.Reader
+}
+
+func (r lockedReader) Read(p []byte) (int, error) {
+	if err := context.Cause(r.l.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// release stops refreshing the lock and gives it up, unless another request holds it by now
+func (l *uploadLock) release() {
+	l.cancel(nil)
+	<-l.done
+	if err := l.lock.Release(context.Background()); err != nil && err != redislock.ErrLockNotHeld {
+		slog.Warn("Failed to release upload lock", "id", l.id, "error", err)
+	}
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, a comma separated list of "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if kv[0] == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		if len(kv) == 1 {
+			metadata[kv[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		metadata[kv[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusMiddleware rejects requests for a tus version we don't speak and adds the Tus-Resumable header to every reply
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			ReplyWithJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "unsupported tus version"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusRouter(inputRouter chi.Router) {
+	inputRouter.With(tusMiddleware).Head("/upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+		upload, err := getTusUpload(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	inputRouter.With(tusMiddleware).Patch("/upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// not the request context, the offset must still be saved when the client disconnects halfway
+		ctx := context.Background()
+		id := chi.URLParam(r, "id")
+
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			ReplyWithJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "content type must be application/offset+octet-stream"})
+			return
+		}
+
+		// only one PATCH may write to an upload at a time
+		lock := lockUpload(ctx, w, id)
+		if lock == nil {
+			return
+		}
+		defer lock.release()
+
+		upload, err := getTusUpload(ctx, id)
+		if err == redis.Nil {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "upload does not exist"})
+			return
+		}
+		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to get upload"})
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid Upload-Offset"})
+			return
+		}
+		if offset != upload.Offset {
+			ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": "Upload-Offset does not match current offset"})
+			return
+		}
+
+		// stage the chunk. whatever arrives before the connection drops is kept, so the client can resume from there
+		writer, err := storage.Create(tusPartPath(id, offset))
+		if err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to store chunk"})
+			return
+		}
+		written, copyErr := io.Copy(writer, lock.reader(io.LimitReader(r.Body, upload.Length-upload.Offset)))
+		if errors.Is(copyErr, errUploadLockLost) {
+			// the request holding the lock now owns the upload, the chunk isn't kept
+			storage.Abort(writer, copyErr)
+			ReplyWithJSON(w, http.StatusLocked, map[string]string{"error": "upload is in use"})
+			return
+		}
+		if err := writer.Close(); err != nil {
+			slog.Error("Failed to store upload chunk", "id", id, "offset", offset, "error", err)
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to store chunk"})
+			return
+		}
+		if written > 0 {
+			upload.Parts = append(upload.Parts, offset)
+			upload.Offset += written
+		} else {
+			storage.FileDelete(tusPartPath(id, offset))
+		}
+		if err := saveTusUpload(ctx, upload); err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save upload"})
+			return
+		}
+		if copyErr != nil {
+			slog.Warn("Upload chunk interrupted", "id", id, "offset", upload.Offset, "error", copyErr)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "upload interrupted"})
+			return
+		}
+
+		if upload.Offset == upload.Length {
+			if err := finishTusUpload(ctx, upload); err != nil {
+				if errors.Is(err, encoder.ErrJobActive) {
+					ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+					return
+				}
+				if errors.Is(err, errIdempotencyKeyUsed) {
+					ReplyWithJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+					return
+				}
+				slog.Error("Failed to finish upload", "id", id, "error", err)
+				ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to finish upload"})
+				return
+			}
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	inputRouter.With(tusMiddleware).Delete("/upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.Background()
+		id := chi.URLParam(r, "id")
+		// a PATCH still writing would stage its chunk after the upload is gone
+		lock := lockUpload(ctx, w, id)
+		if lock == nil {
+			return
+		}
+		defer lock.release()
+		if _, err := getTusUpload(ctx, id); err != nil {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "upload does not exist"})
+			return
+		}
+		if err := storage.DirectoryDelete("tmp/" + id + "/parts"); err != nil {
+			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete upload"})
+			return
+		}
+		removeTusUpload(ctx, id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// createTusUpload handles the creation extension: a POST on /upload with the Tus-Resumable header
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		ReplyWithJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "unsupported tus version"})
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Upload-Length is required"})
+		return
+	}
+	if maxSize := tusMaxSize(); maxSize > 0 && length > maxSize {
+		ReplyWithJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "upload is too large"})
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid Upload-Metadata"})
+		return
+	}
+	// the job settings can be passed as metadata or, like the multipart upload, as query params
+	for _, key := range []string{"id", "profiles", "ladder", "queue", "priority", "callback_url"} {
+		if metadata[key] == "" {
+			metadata[key] = r.URL.Query().Get(key)
+		}
+	}
+	id := metadata["id"]
+
+	// the upload was finished and queued already
+	if replayIdempotent(w, r, id) {
+		return
+	}
+	if !checkNewId(w, id) {
+		return
+	}
+	profiles, ok := resolveProfiles(w, metadata["profiles"], metadata["ladder"])
+	if !ok {
+		return
+	}
+	options, ok := jobOptions(w, metadata["queue"], metadata["priority"], metadata["callback_url"])
+	if !ok {
+		return
+	}
+	options.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+	upload := tusUpload{
+		Id:       id,
+		Profiles: profiles,
+		Options:  options,
+		Length:   length,
+		Parts:    []int64{},
+	}
+	data, err := json.Marshal(upload)
+	if err != nil {
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create upload"})
+		return
+	}
+	created, err := encoder.Redis.SetNX(r.Context(), "upload:"+id, string(data), tusUploadExpiry).Result()
+	if err != nil {
+		ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create upload"})
+		return
+	}
+	if !created {
+		// a retried creation gets the upload its first attempt created
+		if existing, err := getTusUpload(r.Context(), id); err == nil && options.IdempotencyKey != "" && existing.Options.IdempotencyKey == options.IdempotencyKey {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Location", "/api/upload/"+id)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		ReplyWithJSON(w, http.StatusConflict, map[string]string{"error": "an upload for this id is already in progress"})
+		return
+	}
+	trackTusUpload(r.Context(), encoder.Redis, id)
+
+	w.Header().Set("Location", "/api/upload/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// finishTusUpload stitches the staged chunks together into the input file and queues the job
+func finishTusUpload(ctx context.Context, upload tusUpload) error {
+	//a job queued for the id since the upload was created would have its input overwritten
+	active, err := encoder.JobActive(ctx, upload.Id)
+	if err != nil {
+		return err
+	}
+	if active {
+		return encoder.ErrJobActive
+	}
+	input := "tmp/" + upload.Id + "/" + "input"
+	writer, err := storage.Create(input)
+	if err != nil {
+		return err
+	}
+	for _, offset := range upload.Parts {
+		part, err := storage.Open(tusPartPath(upload.Id, offset))
+		if err != nil {
+			storage.Abort(writer, err)
+			return err
+		}
+		_, err = io.Copy(writer, part)
+		part.Close()
+		if err != nil {
+			storage.Abort(writer, err)
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	// the chunks are only removed once the job is queued, until then the client can finish the upload again
+	queued, err := encoder.AddFileToQueue(input, upload.Id, upload.Profiles, upload.Options)
+	if err != nil {
+		return err
+	}
+	if queued != upload.Id {
+		return fmt.Errorf("%w %s", errIdempotencyKeyUsed, queued)
+	}
+	if err := storage.DirectoryDelete("tmp/" + upload.Id + "/parts"); err != nil {
+		slog.Warn("Failed to remove upload chunks", "id", upload.Id, "error", err)
+	}
+	removeTusUpload(ctx, upload.Id)
+	slog.Info("Resumable upload finished", "id", upload.Id, "size", upload.Length)
+	return nil
+}
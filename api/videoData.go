@@ -1,6 +1,7 @@
 package api
 
 import (
+	"goenc/encoder"
 	"goenc/storage"
 	"net/http"
 	"os"
@@ -76,18 +77,32 @@ func VideoDataRouter(inputRouter chi.Router) {
 
 		storage.ServeFile(id+"/master.m3u8", w, false)
 	})
+	r.Get("/dash", func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("id")
+
+		//served directly instead of redirected, the segment urls in the manifest are relative to our origin
+		result, err := storage.FileGet(id+"/manifest.mpd", true)
+		if err != nil {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "no dash manifest for this video"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Write(*result.Data)
+	})
 	r.Get("/{res}", func(w http.ResponseWriter, r *http.Request) {
 		id := r.Header.Get("id")
 		res := chi.URLParam(r, "res")
 
-		if !resValid(res) {
+		// a rendition that wasn't encoded is a 404 from storage, reading meta.json on every segment is too slow
+		if !encoder.ValidLabel(res) {
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid resolution"})
 			return
 		}
 
 		result, err := storage.FileGet(id+"/"+res+"/index.m3u8", true)
-		if err != nil {
-			ReplyWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to get index.m3u8"})
+		if err != nil || result.Data == nil {
+			ReplyWithJSON(w, http.StatusNotFound, map[string]string{"error": "resolution not found"})
 			return
 		}
 		stringRes := string(*result.Data)
@@ -106,7 +121,7 @@ func VideoDataRouter(inputRouter chi.Router) {
 		id := r.Header.Get("id")
 		res := chi.URLParam(r, "res")
 		seg := chi.URLParam(r, "seg")
-		if !resValid(res) {
+		if !encoder.ValidLabel(res) {
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid resolution"})
 			return
 		}
@@ -122,7 +137,7 @@ func VideoDataRouter(inputRouter chi.Router) {
 	r.Get("/{res}/init", func(w http.ResponseWriter, r *http.Request) {
 		id := r.Header.Get("id")
 		res := chi.URLParam(r, "res")
-		if !resValid(res) {
+		if !encoder.ValidLabel(res) {
 			ReplyWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid resolution"})
 			return
 		}
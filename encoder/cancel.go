@@ -0,0 +1,120 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"goenc/storage"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrJobNotFound      = errors.New("job does not exist")
+	ErrJobNotCancelable = errors.New("job already finished")
+)
+
+// how often a worker checks whether its job was cancelled
+const cancelPollInterval = 2 * time.Second
+
+// cancel:{id} is set for jobs a worker has to stop, it expires in case no worker ever picks it up
+const cancelTTL = 24 * time.Hour
+
+func cancelKey(id string) string {
+	return "cancel:" + id
+}
+
+// CancelJob cancels a job. Waiting jobs are removed from the queue right away,
+// processing jobs are flagged for their worker, which kills ffmpeg and marks the job cancelled.
+func CancelJob(id string) (QueueItem, error) {
+	ctx := context.Background()
+	data, err := GetQueueItem(ctx, id)
+	if err != nil {
+		return data, err
+	}
+
+	switch data.Status {
+	case Waiting:
+		removed, err := Redis.ZRem(ctx, queueKey(data.queueName()), id).Result()
+		if err != nil {
+			return data, err
+		}
+		// waiting for a retry
+		if delayed, err := Redis.ZRem(ctx, delayedKey, id).Result(); err == nil {
+			removed += delayed
+		}
+		// not yet moved out of the list older versions queued into
+		if legacy, err := Redis.LRem(ctx, "queue:all", 0, id).Result(); err == nil {
+			removed += legacy
+		}
+		if removed == 0 {
+			// a worker took it in the meantime, it is stopped like a processing job once the worker starts it
+			break
+		}
+		slog.Info("Cancelled waiting job", "id", id)
+		removeCancelledFiles(data)
+		err = UpdateQueueItem(id, func(item *QueueItem) error {
+			setStatus(item, Cancelled, 0, "cancelled")
+			data = *item
+			return nil
+		})
+		return data, err
+	case Processing:
+	default:
+		return data, ErrJobNotCancelable
+	}
+
+	slog.Info("Cancelling processing job", "id", id, "worker_id", data.WorkerID)
+	if err := Redis.Set(ctx, cancelKey(id), "1", cancelTTL).Err(); err != nil {
+		return data, err
+	}
+	err = UpdateQueueItem(id, func(item *QueueItem) error {
+		if item.Status != Processing && item.Status != Waiting {
+			return ErrJobNotCancelable
+		}
+		setStep(item, "cancelling")
+		data = *item
+		return nil
+	})
+	if errors.Is(err, ErrJobNotCancelable) {
+		// the job finished meanwhile, the flag would stop the next job queued under the id
+		Redis.Del(ctx, cancelKey(id))
+	}
+	return data, err
+}
+
+// watchCancel cancels the job context once the job is flagged for cancellation, until ctx is done
+func watchCancel(ctx context.Context, id string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		if exists, err := Redis.Exists(ctx, cancelKey(id)).Result(); err == nil && exists > 0 {
+			slog.Info("Job cancelled, stopping", "id", id)
+			cancel()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finishCancelledJob cleans up after a job that was stopped by CancelJob
+func finishCancelledJob(data QueueItem) {
+	storage.LocalDirectoryDelete("tmp/" + data.Id)
+	removeCancelledFiles(data)
+	if err := modifyClaimedQueueItem(data.Id, Cancelled, 0, "cancelled"); err != nil {
+		slog.Error("Failed to set item to cancelled", "id", data.Id, "error", err)
+	}
+}
+
+// removeCancelledFiles removes the uploaded source and any renditions already written for a cancelled job
+func removeCancelledFiles(data QueueItem) {
+	if !storage.FileExists(data.Id + "/meta.json") {
+		storage.DirectoryDelete(data.Id)
+	}
+	if !IsRemoteSource(data.Source) {
+		storage.DirectoryDelete("tmp/" + data.Id)
+	}
+}
@@ -0,0 +1,215 @@
+package encoder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// videoCodec describes how to drive an ffmpeg video encoder and how players should identify its output
+type videoCodec struct {
+	DefaultPreset string
+	Presets       []string
+	// TwoPass is false for encoders that can't do a separate analysis pass
+	TwoPass bool
+	// MaxQuality is the highest crf and qp the encoder accepts
+	MaxQuality int
+	// speedArgs translates the preset of a profile into encoder options
+	speedArgs func(preset string) ffmpeg.KwArgs
+	// passArgs are the options for one pass of a two pass encode
+	passArgs func(pass int, logfile string) ffmpeg.KwArgs
+	// rateArgs are the options for the rate control mode of a profile, defaultRateArgs when nil
+	rateArgs func(sm SizeMappingType) ffmpeg.KwArgs
+	// codecString is the RFC 6381 codec string for the CODECS attribute, given a level index from levelIndex
+	codecString func(level int) string
+}
+
+var x26xPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+func numberedPresets(min int, max int) []string {
+	presets := []string{}
+	for i := min; i <= max; i++ {
+		presets = append(presets, strconv.Itoa(i))
+	}
+	return presets
+}
+
+func ffmpegPassArgs(pass int, logfile string) ffmpeg.KwArgs {
+	return ffmpeg.KwArgs{
+		"pass":        strconv.Itoa(pass),
+		"passlogfile": logfile,
+	}
+}
+
+// defaultRateArgs covers encoders that implement the generic ffmpeg rate control options, like x264 and x265
+func defaultRateArgs(sm SizeMappingType) ffmpeg.KwArgs {
+	switch sm.RateControl {
+	case RateControlCappedCRF:
+		return ffmpeg.KwArgs{"crf": strconv.Itoa(sm.Crf), "maxrate": sm.Maxrate, "bufsize": sm.Bufsize}
+	case RateControlCQP:
+		return ffmpeg.KwArgs{"qp": strconv.Itoa(sm.QP)}
+	default:
+		return ffmpeg.KwArgs{"b:v": sm.VideoBitrate, "maxrate": sm.Maxrate, "bufsize": sm.Bufsize}
+	}
+}
+
+// libvpxRateArgs uses constrained quality for capped crf, libvpx caps at b:v in that mode.
+// libvpx and libaom have no constant quantizer mode, constant quality with an unconstrained bitrate is the closest.
+func libvpxRateArgs(sm SizeMappingType) ffmpeg.KwArgs {
+	switch sm.RateControl {
+	case RateControlCappedCRF:
+		return ffmpeg.KwArgs{"crf": strconv.Itoa(sm.Crf), "b:v": sm.Maxrate, "bufsize": sm.Bufsize}
+	case RateControlCQP:
+		return ffmpeg.KwArgs{"crf": strconv.Itoa(sm.QP), "b:v": "0"}
+	default:
+		return defaultRateArgs(sm)
+	}
+}
+
+// levels used for the codec strings: 3.0, 3.1, 4.0, 4.1, 5.0, 5.1, 5.2
+var (
+	h264Levels = []string{"1e", "1f", "28", "29", "32", "33", "34"}
+	hevcLevels = []int{90, 93, 120, 123, 150, 153, 156}
+	vp9Levels  = []string{"30", "31", "40", "41", "50", "51", "52"}
+	av1Levels  = []string{"04", "05", "08", "09", "12", "13", "14"}
+)
+
+var videoCodecs = map[string]videoCodec{
+	"libx264": {
+		DefaultPreset: "slow",
+		Presets:       x26xPresets,
+		TwoPass:       true,
+		MaxQuality:    51,
+		speedArgs: func(preset string) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"preset": preset}
+		},
+		passArgs: ffmpegPassArgs,
+		codecString: func(level int) string {
+			return "avc1.6400" + h264Levels[level] // high profile
+		},
+	},
+	"libx265": {
+		DefaultPreset: "medium",
+		Presets:       x26xPresets,
+		TwoPass:       true,
+		MaxQuality:    51,
+		speedArgs: func(preset string) ffmpeg.KwArgs {
+			// hvc1 instead of the default hev1 tag, Apple players require it
+			return ffmpeg.KwArgs{"preset": preset, "tag:v": "hvc1"}
+		},
+		// libx265 ignores -pass, the stats file has to go through x265-params
+		passArgs: func(pass int, logfile string) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"x265-params": fmt.Sprintf("log-level=error:pass=%d:stats=%s", pass, logfile)}
+		},
+		codecString: func(level int) string {
+			return fmt.Sprintf("hvc1.1.6.L%d.B0", hevcLevels[level]) // main profile
+		},
+	},
+	"libvpx-vp9": {
+		DefaultPreset: "2",
+		Presets:       numberedPresets(0, 8),
+		TwoPass:       true,
+		MaxQuality:    63,
+		speedArgs: func(preset string) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"deadline": "good", "cpu-used": preset, "row-mt": "1"}
+		},
+		passArgs: ffmpegPassArgs,
+		rateArgs: libvpxRateArgs,
+		codecString: func(level int) string {
+			return "vp09.00." + vp9Levels[level] + ".08" // profile 0, 8 bit
+		},
+	},
+	"libsvtav1": {
+		DefaultPreset: "8",
+		Presets:       numberedPresets(0, 13),
+		TwoPass:       false,
+		MaxQuality:    63,
+		speedArgs: func(preset string) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"preset": preset}
+		},
+		// SVT-AV1 only accepts a maximum bitrate in crf mode
+		rateArgs: func(sm SizeMappingType) ffmpeg.KwArgs {
+			switch sm.RateControl {
+			case RateControlCappedCRF:
+				return ffmpeg.KwArgs{"crf": strconv.Itoa(sm.Crf), "maxrate": sm.Maxrate}
+			case RateControlCQP:
+				return ffmpeg.KwArgs{"qp": strconv.Itoa(sm.QP)}
+			default:
+				return ffmpeg.KwArgs{"b:v": sm.VideoBitrate}
+			}
+		},
+		codecString: func(level int) string {
+			return "av01.0." + av1Levels[level] + "M.08" // main profile, 8 bit
+		},
+	},
+	"libaom-av1": {
+		DefaultPreset: "4",
+		Presets:       numberedPresets(0, 8),
+		TwoPass:       true,
+		MaxQuality:    63,
+		speedArgs: func(preset string) ffmpeg.KwArgs {
+			return ffmpeg.KwArgs{"cpu-used": preset, "row-mt": "1"}
+		},
+		passArgs: ffmpegPassArgs,
+		rateArgs: libvpxRateArgs,
+		codecString: func(level int) string {
+			return "av01.0." + av1Levels[level] + "M.08"
+		},
+	},
+}
+
+// audioCodecs maps the supported ffmpeg audio encoders to their codec strings
+var audioCodecs = map[string]string{
+	"aac":     "mp4a.40.2",
+	"libopus": "Opus",
+}
+
+func codecNames[T any](codecs map[string]T) []string {
+	names := []string{}
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// levelIndex picks a codec level that fits the output resolution and frame rate
+func levelIndex(height int, frameRate float64) int {
+	var level int
+	switch {
+	case height <= 480:
+		level = 0
+	case height <= 720:
+		level = 1
+	case height <= 1080:
+		level = 2
+	case height <= 1440:
+		level = 4
+	default:
+		level = 5
+	}
+	if frameRate > 30 {
+		level++
+	}
+	return min(level, len(h264Levels)-1)
+}
+
+// twoPass reports whether a profile is encoded in two passes
+func (sm SizeMappingType) twoPass() bool {
+	return sm.RateControl == RateControlTwoPass && videoCodecs[sm.Codec].TwoPass
+}
+
+// rateArgs returns the rate control options of a profile for its codec
+func (sm SizeMappingType) rateArgs() ffmpeg.KwArgs {
+	if rateArgs := videoCodecs[sm.Codec].rateArgs; rateArgs != nil {
+		return rateArgs(sm)
+	}
+	return defaultRateArgs(sm)
+}
+
+// CodecsAttribute returns the value of the CODECS attribute for a rendition, e.g. "avc1.640028,mp4a.40.2"
+func (sm SizeMappingType) CodecsAttribute(height int, frameRate float64) string {
+	return videoCodecs[sm.Codec].codecString(levelIndex(height, frameRate)) + "," + audioCodecs[sm.AudioCodec]
+}
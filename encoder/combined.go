@@ -0,0 +1,191 @@
+package encoder
+
+import (
+	"context"
+	"fmt"
+	"goenc/storage"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// Encode modes, set with ENCODE_MODE
+const (
+	// EncodeModeSeparate runs ffmpeg for every rendition, decoding the source once or twice per rendition
+	EncodeModeSeparate = "separate"
+	// EncodeModeCombined decodes the source once per pass and splits it into all renditions in one ffmpeg run
+	EncodeModeCombined = "combined"
+)
+
+func encodeMode() string {
+	if os.Getenv("ENCODE_MODE") == EncodeModeCombined {
+		return EncodeModeCombined
+	}
+	return EncodeModeSeparate
+}
+
+// streamArgs scopes output options to the index-th output stream of a kind ("v" or "a"),
+// e.g. "b:v" becomes "b:v:2" and "preset" becomes "preset:v:2"
+func streamArgs(args ffmpeg.KwArgs, kind string, index int) ffmpeg.KwArgs {
+	scoped := ffmpeg.KwArgs{}
+	for key, value := range args {
+		key = strings.TrimSuffix(key, ":"+kind)
+		scoped[fmt.Sprintf("%s:%s:%d", key, kind, index)] = value
+	}
+	return scoped
+}
+
+// scaledStreams splits the video of the source into a scaled stream per rendition
+func scaledStreams(input *ffmpeg.Stream, renditions []SizeMappingType) []*ffmpeg.Stream {
+	split := input.Video().Split()
+	streams := []*ffmpeg.Stream{}
+	for i, sm := range renditions {
+		streams = append(streams, split.Get(strconv.Itoa(i)).Filter("scale", ffmpeg.Args{}, ffmpeg.KwArgs{
+			"w":                           strconv.Itoa(sm.Width),
+			"h":                           strconv.Itoa(sm.Height),
+			"force_original_aspect_ratio": "decrease",
+			"force_divisible_by":          "2",
+		}))
+	}
+	return streams
+}
+
+// combinedRuns is the number of ffmpeg runs encodeCombined needs
+func combinedRuns(renditions []SizeMappingType) int {
+	for _, sm := range renditions {
+		if sm.twoPass() {
+			return 2
+		}
+	}
+	return 1
+}
+
+// encodeCombined encodes all renditions in a single ffmpeg run per pass, writing the same files into tmp/{id}/{label} as encodeRendition.
+// Renditions that need two passes share one first pass, the other renditions are left out of it.
+func encodeCombined(ctx context.Context, id string, local_input string, hwaccel string, renditions []SizeMappingType, hasAudio bool, progress *encodeProgress) error {
+	dir := storage.LocalStoragePath + "/tmp/" + id
+	labels := []string{}
+	twoPass := []SizeMappingType{}
+	onePass := []SizeMappingType{}
+	for _, sm := range renditions {
+		labels = append(labels, sm.Label)
+		if sm.twoPass() {
+			twoPass = append(twoPass, sm)
+		} else {
+			onePass = append(onePass, sm)
+		}
+	}
+	// ffmpeg names the stats file of a pass after the index of the output stream. The two pass renditions are the
+	// first video streams of both passes and the audio streams come after all video streams, so the indexes match.
+	renditions = slices.Concat(twoPass, onePass)
+
+	// First pass (bitrate analysis), only video
+	if len(twoPass) > 0 {
+		reportStatus(id, "first_pass_ready:"+strings.Join(labels, ","))
+		input := ffmpeg.Input(local_input, ffmpeg.KwArgs{
+			"hwaccel": hwaccel,
+		})
+		pass1Args := []ffmpeg.KwArgs{{"f": "null"}}
+		for i, sm := range twoPass {
+			args := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{videoArgs(sm), videoCodecs[sm.Codec].passArgs(1, dir+"/"+sm.Label+"/logfile")})
+			delete(args, "vf")
+			pass1Args = append(pass1Args, streamArgs(args, "v", i))
+		}
+		pass1 := ffmpeg.Output(scaledStreams(input, twoPass), "/dev/null", ffmpeg.MergeKwArgs(pass1Args)).OverWriteOutput()
+
+		slog.Info("Encoding combined first pass", "id", id, "resolutions", labels)
+		reportStatus(id, "encoding_first_pass:"+strings.Join(labels, ","))
+		if err := progress.run(ctx, pass1); err != nil {
+			slog.Error("Failed to encode combined first pass", "id", id, "error", err)
+			reportStatus(id, "error_first_pass:"+strings.Join(labels, ","))
+			return err
+		}
+	}
+
+	// Second pass, every rendition into its own variant stream. %v is replaced by the name in var_stream_map
+	reportStatus(id, "second_pass_ready:"+strings.Join(labels, ","))
+	input := ffmpeg.Input(local_input, ffmpeg.KwArgs{
+		"hwaccel": hwaccel,
+	})
+	streams := []*ffmpeg.Stream{}
+	variants := []string{}
+	pass2Args := []ffmpeg.KwArgs{hlsArgs(dir + "/%v")}
+	for i, video := range scaledStreams(input, renditions) {
+		sm := renditions[i]
+		args := videoArgs(sm)
+		delete(args, "vf")
+		if sm.twoPass() {
+			args = ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{args, videoCodecs[sm.Codec].passArgs(2, dir+"/"+sm.Label+"/logfile")})
+		}
+		pass2Args = append(pass2Args, streamArgs(args, "v", i))
+		streams = append(streams, video)
+
+		variant := fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			variant += fmt.Sprintf(",a:%d", i)
+		}
+		variants = append(variants, variant+",name:"+sm.Label)
+	}
+	if hasAudio {
+		// only the first audio track, var_stream_map expects one audio stream per variant
+		for i, sm := range renditions {
+			pass2Args = append(pass2Args, streamArgs(audioArgs(sm), "a", i))
+			streams = append(streams, input.Get("a:0"))
+		}
+	}
+	pass2Args = append(pass2Args, ffmpeg.KwArgs{
+		"f":              "hls",
+		"var_stream_map": strings.Join(variants, " "),
+	})
+	pass2 := ffmpeg.Output(streams, dir+"/%v/index.m3u8", ffmpeg.MergeKwArgs(pass2Args)).OverWriteOutput()
+
+	slog.Info("Encoding combined second pass", "id", id, "resolutions", labels)
+	reportStatus(id, "encoding_second_pass:"+strings.Join(labels, ","))
+	if err := progress.run(ctx, pass2); err != nil {
+		slog.Error("Failed to encode combined second pass", "id", id, "error", err)
+		reportStatus(id, "error_second_pass:"+strings.Join(labels, ","))
+		return err
+	}
+
+	for _, sm := range renditions {
+		reportStatus(id, "encoded_size:"+sm.Label)
+		if err := renameInitSegment(dir + "/" + sm.Label); err != nil {
+			reportStatus(id, "error_init_segment:"+sm.Label)
+			return err
+		}
+	}
+	return nil
+}
+
+var initSegmentPattern = regexp.MustCompile(`^init_.+\.mp4$`)
+
+// renameInitSegment renames the init segment of a variant stream back to init.mp4.
+// With multiple variant streams ffmpeg suffixes the init segment with the stream index, the data routes expect init.mp4.
+func renameInitSegment(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !initSegmentPattern.MatchString(entry.Name()) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(dir, "init.mp4")); err != nil {
+			return err
+		}
+		playlistPath := filepath.Join(dir, "index.m3u8")
+		playlist, err := os.ReadFile(playlistPath)
+		if err != nil {
+			return err
+		}
+		playlist = []byte(strings.ReplaceAll(string(playlist), `URI="`+entry.Name()+`"`, `URI="init.mp4"`))
+		return os.WriteFile(playlistPath, playlist, 0644)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package encoder
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// MPD types, only what is needed for a static manifest of the fMP4 segments the HLS encode produces
+
+type mpd struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod
+}
+
+type mpdPeriod struct {
+	XMLName        xml.Name           `xml:"Period"`
+	Id             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	Id                 int                 `xml:"id,attr"`
+	MimeType           string              `xml:"mimeType,attr"`
+	SegmentAlignment   bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP       int                 `xml:"startWithSAP,attr"`
+	MaxWidth           int                 `xml:"maxWidth,attr"`
+	MaxHeight          int                 `xml:"maxHeight,attr"`
+	AudioChannelConfig *mpdDescriptor      `xml:"AudioChannelConfiguration,omitempty"`
+	Representations    []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdDescriptor struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	Id              string             `xml:"id,attr"`
+	Bandwidth       int                `xml:"bandwidth,attr"`
+	Width           int                `xml:"width,attr"`
+	Height          int                `xml:"height,attr"`
+	FrameRate       string             `xml:"frameRate,attr,omitempty"`
+	Codecs          string             `xml:"codecs,attr"`
+	SegmentTemplate mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale      int          `xml:"timescale,attr"`
+	Initialization string       `xml:"initialization,attr"`
+	Media          string       `xml:"media,attr"`
+	StartNumber    int          `xml:"startNumber,attr"`
+	Timeline       []mpdSegment `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegment struct {
+	Duration int64 `xml:"d,attr"`
+	Repeat   int   `xml:"r,attr,omitempty"`
+}
+
+// segment durations are written in milliseconds
+const mpdTimescale = 1000
+
+func mpdDuration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', 3, 64) + "S"
+}
+
+// mpdFrameRate formats a frame rate as an integer or, for NTSC rates like 29.97, a fraction
+func mpdFrameRate(rate float64) string {
+	if rate == math.Round(rate) {
+		return strconv.Itoa(int(rate))
+	}
+	return strconv.Itoa(int(math.Round(rate*1001))) + "/1001"
+}
+
+// mpdTimeline turns segment durations into a SegmentTimeline, merging runs of equal durations.
+// Durations are rounded from the running total so rounding errors don't add up over long videos.
+func mpdTimeline(segments []mediaSegment) []mpdSegment {
+	timeline := []mpdSegment{}
+	elapsed := 0.0
+	var start int64
+	for _, segment := range segments {
+		elapsed += segment.Duration
+		end := int64(math.Round(elapsed * mpdTimescale))
+		duration := end - start
+		start = end
+		if last := len(timeline) - 1; last >= 0 && timeline[last].Duration == duration {
+			timeline[last].Repeat++
+			continue
+		}
+		timeline = append(timeline, mpdSegment{Duration: duration})
+	}
+	return timeline
+}
+
+// buildDashManifest writes an MPD referencing the segments through the /data routes, the same urls the HLS playlists are rewritten to.
+// Renditions are grouped into an adaptation set per codec, as players can't switch codecs within one.
+func buildDashManifest(renditions []rendition) ([]byte, error) {
+	manifest := mpd{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: mpdDuration(4),
+		Period: mpdPeriod{
+			Id:    "0",
+			Start: mpdDuration(0),
+		},
+	}
+
+	duration := 0.0
+	sets := map[string]int{}
+	for _, r := range renditions {
+		duration = math.Max(duration, r.Duration())
+
+		key := r.Profile.Codec + "/" + r.Profile.AudioCodec
+		index, ok := sets[key]
+		if !ok {
+			index = len(manifest.Period.AdaptationSets)
+			sets[key] = index
+			manifest.Period.AdaptationSets = append(manifest.Period.AdaptationSets, mpdAdaptationSet{
+				Id:               index,
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+			})
+			if r.Profile.AudioChannels > 0 {
+				manifest.Period.AdaptationSets[index].AudioChannelConfig = &mpdDescriptor{
+					SchemeIdUri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       strconv.Itoa(r.Profile.AudioChannels),
+				}
+			}
+		}
+		set := &manifest.Period.AdaptationSets[index]
+		set.MaxWidth = max(set.MaxWidth, r.Width)
+		set.MaxHeight = max(set.MaxHeight, r.Height)
+
+		representation := mpdRepresentation{
+			Id:        r.Profile.Label,
+			Bandwidth: r.Bandwidth(),
+			Width:     r.Width,
+			Height:    r.Height,
+			Codecs:    r.Profile.CodecsAttribute(r.Height, r.FrameRate),
+			SegmentTemplate: mpdSegmentTemplate{
+				Timescale:      mpdTimescale,
+				Initialization: "/data/" + r.Profile.Label + "/init",
+				Media:          "/data/" + r.Profile.Label + "/$Number%03d$",
+				StartNumber:    0,
+				Timeline:       mpdTimeline(r.Segments),
+			},
+		}
+		if r.FrameRate > 0 {
+			representation.FrameRate = mpdFrameRate(r.FrameRate)
+		}
+		set.Representations = append(set.Representations, representation)
+	}
+	manifest.MediaPresentationDuration = mpdDuration(duration)
+
+	data, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mpd: %w", err)
+	}
+	return append([]byte(xml.Header), data...), nil
+}
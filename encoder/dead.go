@@ -0,0 +1,203 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Jobs that failed for good are moved to the dead sorted set, scored by the unix time in milliseconds they failed.
+// dead:{id} keeps the failure and a copy of the queue item, so the job can be retried after the item was cleaned up.
+const deadSetKey = "dead"
+
+func deadKey(id string) string {
+	return "dead:" + id
+}
+
+var ErrDeadJobChanged = errors.New("dead job changed while retrying it")
+
+// DeadJob is a job that failed after all of its attempts
+type DeadJob struct {
+	Id       string    `json:"id"`
+	Error    string    `json:"error"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Attempts int       `json:"attempts"`
+	WorkerID string    `json:"worker_id"`
+	FailedAt time.Time `json:"failed_at"`
+	Item     QueueItem `json:"item"`
+}
+
+// buryJob removes the claim of worker on a job that failed for good, and the job from its queue, and adds it to the dead jobs
+func buryJob(ctx context.Context, worker string, data QueueItem, jobErr error) {
+	dead := DeadJob{
+		Id:       data.Id,
+		Error:    jobErr.Error(),
+		Attempts: data.Attempts,
+		WorkerID: worker,
+		FailedAt: time.Now(),
+		Item:     data,
+	}
+	var ffmpegErr *FFmpegError
+	if errors.As(jobErr, &ffmpegErr) {
+		dead.Stderr = ffmpegErr.Stderr
+	}
+	jsonData, err := json.Marshal(dead)
+	if err != nil {
+		slog.Error("Failed to marshal dead job", "id", data.Id, "error", err)
+		releaseJob(ctx, data.Id)
+		return
+	}
+	_, err = Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingKey(worker), 0, data.Id)
+		pipe.ZRem(ctx, leasesKey, data.Id)
+		pipe.ZRem(ctx, queueKey(data.queueName()), data.Id)
+		pipe.Set(ctx, deadKey(data.Id), string(jsonData), 0)
+		pipe.ZAdd(ctx, deadSetKey, &redis.Z{Score: float64(dead.FailedAt.UnixMilli()), Member: data.Id})
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to move job to the dead jobs", "id", data.Id, "error", err)
+	}
+}
+
+// trimDeadJobs removes the dead jobs that are older than the dead retention days or beyond the dead items,
+// returning how many were removed
+func trimDeadJobs(ctx context.Context) int {
+	expired := []string{}
+	if retention.DeadDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -retention.DeadDays)
+		old, err := Redis.ZRangeByScore(ctx, deadSetKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: "(" + strconv.FormatInt(cutoff.UnixMilli(), 10),
+		}).Result()
+		if err != nil {
+			slog.Error("Failed to list dead jobs", "error", err)
+			return 0
+		}
+		expired = append(expired, old...)
+	}
+	if retention.DeadItems > 0 {
+		beyond, err := Redis.ZRevRange(ctx, deadSetKey, int64(retention.DeadItems), -1).Result()
+		if err != nil {
+			slog.Error("Failed to list dead jobs", "error", err)
+			return 0
+		}
+		expired = append(expired, beyond...)
+	}
+	removed := 0
+	for _, id := range expired {
+		_, err := Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, deadKey(id))
+			pipe.ZRem(ctx, deadSetKey, id)
+			return nil
+		})
+		if err == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// GetDeadJobs lists the dead jobs, most recently failed first
+func GetDeadJobs() ([]DeadJob, error) {
+	ctx := context.Background()
+	ids, err := Redis.ZRevRange(ctx, deadSetKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	dead := []DeadJob{}
+	if len(ids) == 0 {
+		return dead, nil
+	}
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, deadKey(id))
+	}
+	items, err := Redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		value, ok := item.(string)
+		if !ok {
+			// the record is gone, e.g. the job was retried in the meantime
+			continue
+		}
+		var data DeadJob
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			slog.Error("Failed to unmarshal dead job", "id", ids[i], "error", err)
+			continue
+		}
+		dead = append(dead, data)
+	}
+	return dead, nil
+}
+
+// RetryDeadJob puts a dead job back in its queue with a fresh set of attempts. It returns ErrJobActive when a job
+// queued under the same id since is still waiting or processing.
+func RetryDeadJob(id string) (QueueItem, error) {
+	ctx := context.Background()
+	var data QueueItem
+	err := Redis.Watch(ctx, func(tx *redis.Tx) error {
+		record, err := tx.Get(ctx, deadKey(id)).Result()
+		if err == redis.Nil {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var dead DeadJob
+		if err := json.Unmarshal([]byte(record), &dead); err != nil {
+			return err
+		}
+		data = dead.Item
+		// the queue item is newer than the copy, unless it was cleaned up already
+		if item, err := tx.Get(ctx, "queue:"+id).Result(); err == nil {
+			var current QueueItem
+			if err := json.Unmarshal([]byte(item), &current); err != nil {
+				return err
+			}
+			// a job queued again under the id since, it would be queued twice
+			if current.active() {
+				return ErrJobActive
+			}
+			data = current
+		} else if err != redis.Nil {
+			return err
+		}
+		setStatus(&data, Waiting, 0, "")
+		data.Attempts = 0
+		data.Step = ""
+		data.RetryAt = nil
+		data.Version++
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "queue:"+id, string(jsonData), 0)
+			pipe.Del(ctx, cancelKey(id))
+			indexItem(ctx, pipe, data)
+			enqueue(ctx, pipe, data)
+			pipe.Del(ctx, deadKey(id))
+			pipe.ZRem(ctx, deadSetKey, id)
+			return nil
+		})
+		return err
+	}, deadKey(id), "queue:"+id)
+	if err == redis.TxFailedErr {
+		return data, ErrDeadJobChanged
+	}
+	if err != nil {
+		return data, err
+	}
+	slog.Info("Retrying dead job", "id", id, "queue", data.queueName())
+	publishEvent(QueueEventUpdate, data)
+	notify(EventQueued, id, &data, data.CallbackURL)
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRetryDeadJob(t *testing.T) {
+	WorkerID = "w1"
+	tests := []struct {
+		name         string
+		current      *QueueItem // the queue item under the id, nil when it was cleaned up
+		wantErr      error
+		wantAttempts int
+	}{
+		{"failed item", &QueueItem{Id: "job", Status: Fail, Attempts: 3}, nil, 0},
+		{"item cleaned up", nil, nil, 0},
+		{"newer job waiting", &QueueItem{Id: "job", Status: Waiting, Attempts: 1}, ErrJobActive, 1},
+		{"newer job processing", &QueueItem{Id: "job", Status: Processing, WorkerID: "w2", Attempts: 2}, ErrJobActive, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRedis(t)
+			ctx := context.Background()
+			buryJob(ctx, "w1", QueueItem{Id: "job", Status: Fail, Attempts: 3}, errors.New("ffmpeg failed"))
+			if test.current != nil {
+				storeTestItem(t, *test.current)
+			}
+
+			_, err := RetryDeadJob("job")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("RetryDeadJob() = %v, want %v", err, test.wantErr)
+			}
+			item, err := GetQueueItem(ctx, "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.Attempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", item.Attempts, test.wantAttempts)
+			}
+			retried := test.wantErr == nil
+			if queued := Redis.ZScore(ctx, queueKey(DefaultQueue), "job").Err() == nil; queued != retried {
+				t.Errorf("queued = %v, want %v", queued, retried)
+			}
+			if dead := Redis.Exists(ctx, deadKey("job")).Val() == 1; dead == retried {
+				t.Errorf("dead record kept = %v, want %v", dead, !retried)
+			}
+			if retried && item.Status != Waiting {
+				t.Errorf("status = %s, want waiting", item.Status)
+			}
+		})
+	}
+}
+
+func TestRetryDeadJobNotFound(t *testing.T) {
+	useTestRedis(t)
+	if _, err := RetryDeadJob("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("RetryDeadJob() = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestQueueingClearsDeadJob(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	buryJob(ctx, "w1", QueueItem{Id: "job", Status: Fail, Attempts: 3}, errors.New("ffmpeg failed"))
+	storeTestItem(t, QueueItem{Id: "job", Status: Fail, Attempts: 3})
+
+	if _, err := AddFileToQueue("tmp/job/input", "job", "720p", JobOptions{Queue: DefaultQueue, Priority: DefaultPriority}); err != nil {
+		t.Fatal(err)
+	}
+	if Redis.Exists(ctx, deadKey("job")).Val() != 0 || Redis.ZScore(ctx, deadSetKey, "job").Err() == nil {
+		t.Errorf("the dead job of the earlier job is still there")
+	}
+	if _, err := RetryDeadJob("job"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("RetryDeadJob() = %v, want ErrJobNotFound", err)
+	}
+}
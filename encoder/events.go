@@ -0,0 +1,69 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// Every write to a queue item is published on the events:queue channel, so listeners don't have to scan the queue
+const eventsChannel = "events:queue"
+
+const (
+	QueueEventUpdate  = "update"
+	QueueEventRemoved = "removed"
+)
+
+type QueueEvent struct {
+	Type string    `json:"type"`
+	Item QueueItem `json:"item"`
+}
+
+func publishEvent(eventType string, item QueueItem) {
+	jsonData, err := json.Marshal(QueueEvent{Type: eventType, Item: item})
+	if err != nil {
+		return
+	}
+	if err := Redis.Publish(context.Background(), eventsChannel, string(jsonData)).Err(); err != nil {
+		slog.Warn("Failed to publish queue event", "id", item.Id, "error", err)
+	}
+}
+
+// SubscribeQueueEvents streams the queue events of the job with the given id, or of all jobs when id is empty, until ctx is done
+func SubscribeQueueEvents(ctx context.Context, id string) (<-chan QueueEvent, error) {
+	sub := Redis.Subscribe(ctx, eventsChannel)
+	// wait for the subscription so no event is missed after returning
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	events := make(chan QueueEvent)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event QueueEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					continue
+				}
+				if id != "" && event.Item.Id != id {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,233 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Finished jobs are archived into history:{id} when they are removed from the queue, the history sorted set orders
+// them by the time they finished in unix milliseconds. A job id that is reused replaces its earlier history.
+const historyKey = "history"
+
+func historyItemKey(id string) string {
+	return "history:" + id
+}
+
+// retentionPolicy decides how long finished jobs stay in the queue before they are archived,
+// and how much history is kept
+type retentionPolicy struct {
+	// Days finished jobs stay in the queue
+	Days int
+	// Items is the number of finished jobs kept in the queue
+	Items int
+	// HistoryItems is the number of archived jobs kept, 0 keeps all
+	HistoryItems int
+	// DeadDays is how long dead jobs are kept for a retry, 0 keeps them until DeadItems is reached
+	DeadDays int
+	// DeadItems is the number of dead jobs kept, 0 keeps all
+	DeadItems int
+}
+
+var retention = retentionPolicy{
+	Days:         7,
+	Items:        1000,
+	HistoryItems: 10000,
+	DeadDays:     30,
+	DeadItems:    1000,
+}
+
+// InitRetention reads RETENTION_DAYS, RETENTION_ITEMS, HISTORY_ITEMS, DEAD_RETENTION_DAYS and DEAD_ITEMS, unset variables keep their default
+func InitRetention() error {
+	policy := retention
+	settings := map[string]*int{
+		"RETENTION_DAYS":      &policy.Days,
+		"RETENTION_ITEMS":     &policy.Items,
+		"HISTORY_ITEMS":       &policy.HistoryItems,
+		"DEAD_RETENTION_DAYS": &policy.DeadDays,
+		"DEAD_ITEMS":          &policy.DeadItems,
+	}
+	for name, value := range settings {
+		setting := os.Getenv(name)
+		if setting == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(setting)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("%s must be a number of 0 or more, got %q", name, setting)
+		}
+		*value = parsed
+	}
+	retention = policy
+	return nil
+}
+
+// finishedAt is when the job finished, jobs finished before it was recorded count as finished when they were queued
+func (q QueueItem) finishedAt() time.Time {
+	if q.FinishedAt != nil {
+		return *q.FinishedAt
+	}
+	return q.QueuedAt
+}
+
+// archiveJob moves a finished job from the queue to the history, item is the stored json of data.
+// It returns redis.TxFailedErr without archiving when the job changed since it was read.
+func archiveJob(ctx context.Context, data QueueItem, item string) error {
+	key := "queue:" + data.Id
+	err := Redis.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if current != item {
+			return redis.TxFailedErr
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, historyItemKey(data.Id), item, 0)
+			pipe.ZAdd(ctx, historyKey, &redis.Z{Score: float64(data.finishedAt().UnixMilli()), Member: data.Id})
+			pipe.Del(ctx, key)
+			unindexItem(ctx, pipe, data.Id)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return err
+	}
+	publishEvent(QueueEventRemoved, data)
+	return nil
+}
+
+// ApplyRetention archives the finished jobs that are older than the retention days or beyond the retention items,
+// and trims the history and the dead jobs
+func ApplyRetention() {
+	ctx := context.Background()
+	ids := []string{}
+	for _, status := range []Status{Done, Fail, Cancelled} {
+		finished, err := Redis.ZRange(ctx, indexKey(status), 0, -1).Result()
+		if err != nil {
+			slog.Error("Failed to list finished jobs", "status", status, "error", err)
+			return
+		}
+		ids = append(ids, finished...)
+	}
+
+	type finishedJob struct {
+		data QueueItem
+		item string
+	}
+	jobs := []finishedJob{}
+	for start := 0; start < len(ids); start += MaxListLimit {
+		keys := []string{}
+		for _, id := range ids[start:min(start+MaxListLimit, len(ids))] {
+			keys = append(keys, "queue:"+id)
+		}
+		items, err := Redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			slog.Error("Failed to get finished jobs", "error", err)
+			return
+		}
+		for _, item := range items {
+			value, ok := item.(string)
+			if !ok {
+				continue
+			}
+			var data QueueItem
+			if err := json.Unmarshal([]byte(value), &data); err != nil {
+				continue
+			}
+			jobs = append(jobs, finishedJob{data: data, item: value})
+		}
+	}
+	// newest first, everything from the retention items on is archived
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].data.finishedAt().After(jobs[j].data.finishedAt())
+	})
+
+	cutoff := time.Now().AddDate(0, 0, -retention.Days)
+	archived := 0
+	for i, job := range jobs {
+		if i < retention.Items && job.data.finishedAt().After(cutoff) {
+			continue
+		}
+		if err := archiveJob(ctx, job.data, job.item); err != nil {
+			slog.Info("Job changed, not archiving it", "id", job.data.Id, "error", err)
+			continue
+		}
+		archived++
+	}
+
+	trimmed := 0
+	if retention.HistoryItems > 0 {
+		expired, err := Redis.ZRevRange(ctx, historyKey, int64(retention.HistoryItems), -1).Result()
+		if err != nil {
+			slog.Error("Failed to list history", "error", err)
+		}
+		for _, id := range expired {
+			_, err := Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, historyItemKey(id))
+				pipe.ZRem(ctx, historyKey, id)
+				return nil
+			})
+			if err == nil {
+				trimmed++
+			}
+		}
+	}
+	slog.Info("Retention applied", "archived", archived, "history_removed", trimmed, "dead_removed", trimDeadJobs(ctx))
+}
+
+// GetHistory lists archived jobs, most recently finished first, with the total number of archived jobs
+func GetHistory(offset int, limit int) ([]QueueItem, int64, error) {
+	ctx := context.Background()
+	history := []QueueItem{}
+	total, err := Redis.ZCard(ctx, historyKey).Result()
+	if err != nil {
+		return history, 0, err
+	}
+	ids, err := Redis.ZRevRange(ctx, historyKey, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil || len(ids) == 0 {
+		return history, total, err
+	}
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, historyItemKey(id))
+	}
+	items, err := Redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return history, total, err
+	}
+	for _, item := range items {
+		value, ok := item.(string)
+		if !ok {
+			continue
+		}
+		var data QueueItem
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			continue
+		}
+		history = append(history, data)
+	}
+	return history, total, nil
+}
+
+// GetHistoryItem reads an archived job, ErrJobNotFound when it isn't archived
+func GetHistoryItem(ctx context.Context, id string) (QueueItem, error) {
+	var data QueueItem
+	item, err := Redis.Get(ctx, historyItemKey(id)).Result()
+	if err == redis.Nil {
+		return data, ErrJobNotFound
+	}
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal([]byte(item), &data)
+	return data, err
+}
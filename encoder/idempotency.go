@@ -0,0 +1,47 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// idempotency:{key} holds the id of the job queued with an Idempotency-Key, so a retried submission
+// returns that job instead of queueing it again
+const idempotencyTTL = 24 * time.Hour
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const MaxIdempotencyKeyLength = 255
+
+var ErrJobActive = errors.New("a job with this id is already waiting or processing")
+
+func idempotencyKey(key string) string {
+	return "idempotency:" + key
+}
+
+func (q QueueItem) active() bool {
+	return q.Status == Waiting || q.Status == Processing
+}
+
+// JobActive reports whether a job with the id is waiting or processing
+func JobActive(ctx context.Context, id string) (bool, error) {
+	data, err := GetQueueItem(ctx, id)
+	if err == ErrJobNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return data.active(), nil
+}
+
+// IdempotentJob returns the id of the job queued with the idempotency key, or an empty string when the key is unused
+func IdempotentJob(ctx context.Context, key string) (string, error) {
+	id, err := Redis.Get(ctx, idempotencyKey(key)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
@@ -0,0 +1,281 @@
+package encoder
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Queue items are indexed in index:all and index:{status}, sorted sets scored by the time the item was queued
+// in unix milliseconds. Every write of an item updates the indexes in the same transaction.
+
+const indexAllKey = "index:all"
+
+// index:built is set once the items written before the indexes existed are indexed
+const indexBuiltKey = "index:built"
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+var statuses = []Status{Waiting, Processing, Done, Fail, Cancelled}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func indexKey(status Status) string {
+	return "index:" + string(status)
+}
+
+// ValidStatus reports whether status is a known job status
+func ValidStatus(status Status) bool {
+	for _, known := range statuses {
+		if status == known {
+			return true
+		}
+	}
+	return false
+}
+
+// indexScore is the enqueue time of the item, items queued before it was recorded sort first
+func indexScore(item QueueItem) float64 {
+	if item.QueuedAt.IsZero() {
+		return 0
+	}
+	return float64(item.QueuedAt.UnixMilli())
+}
+
+// indexItem moves the item to the index of its status
+func indexItem(ctx context.Context, pipe redis.Cmdable, item QueueItem) {
+	entry := &redis.Z{Score: indexScore(item), Member: item.Id}
+	pipe.ZAdd(ctx, indexAllKey, entry)
+	for _, status := range statuses {
+		if status == item.Status {
+			pipe.ZAdd(ctx, indexKey(status), entry)
+		} else {
+			pipe.ZRem(ctx, indexKey(status), item.Id)
+		}
+	}
+}
+
+// unindexItem removes a deleted item from all indexes
+func unindexItem(ctx context.Context, pipe redis.Cmdable, id string) {
+	pipe.ZRem(ctx, indexAllKey, id)
+	for _, status := range statuses {
+		pipe.ZRem(ctx, indexKey(status), id)
+	}
+}
+
+// BuildQueueIndex indexes the queue items written by versions without indexes, it only scans the queue once
+func BuildQueueIndex() {
+	ctx := context.Background()
+	if exists, err := Redis.Exists(ctx, indexBuiltKey).Result(); err != nil || exists > 0 {
+		return
+	}
+	indexed := 0
+	iter := Redis.Scan(ctx, 0, "queue:*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if key == "queue:all" {
+			continue
+		}
+		item, err := Redis.Get(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		var data QueueItem
+		if err := json.Unmarshal([]byte(item), &data); err != nil {
+			slog.Error("Failed to unmarshal queue item", "key", key, "error", err)
+			continue
+		}
+		indexItem(ctx, Redis, data)
+		indexed++
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("Failed to scan queue keys for the index", "error", err)
+		return
+	}
+	Redis.Set(ctx, indexBuiltKey, "1", 0)
+	slog.Info("Indexed queue items", "count", indexed)
+}
+
+// QueueListOptions filter and page a queue listing
+type QueueListOptions struct {
+	// Statuses to list, all when empty
+	Statuses []Status
+	// Descending lists the most recently queued items first
+	Descending bool
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+type QueueList struct {
+	Items []QueueItem `json:"items"`
+	// Total is the number of items matching the statuses over all pages
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listCursor is the position of the last item of a page
+type listCursor struct {
+	score float64
+	id    string
+}
+
+func (c listCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", int64(c.score), c.id)))
+}
+
+func parseListCursor(value string) (*listCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	score, id, found := strings.Cut(string(decoded), ":")
+	parsed, err := strconv.ParseInt(score, 10, 64)
+	if !found || err != nil || id == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &listCursor{score: float64(parsed), id: id}, nil
+}
+
+// before reports whether entry a sorts before b in the listing order, the same order Redis uses for equal scores
+func before(a redis.Z, b redis.Z, descending bool) bool {
+	if a.Score != b.Score {
+		return (a.Score < b.Score) != descending
+	}
+	if a.Member == b.Member {
+		return false
+	}
+	return (a.Member.(string) < b.Member.(string)) != descending
+}
+
+// indexPage reads up to limit entries of an index that come after the cursor
+func indexPage(ctx context.Context, key string, options QueueListOptions, after *listCursor, limit int) ([]redis.Z, error) {
+	entries := []redis.Z{}
+	for offset := int64(0); ; {
+		by := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Offset: offset, Count: int64(limit)}
+		var batch []redis.Z
+		var err error
+		if options.Descending {
+			if after != nil {
+				by.Max = strconv.FormatInt(int64(after.score), 10)
+			}
+			batch, err = Redis.ZRevRangeByScoreWithScores(ctx, key, by).Result()
+		} else {
+			if after != nil {
+				by.Min = strconv.FormatInt(int64(after.score), 10)
+			}
+			batch, err = Redis.ZRangeByScoreWithScores(ctx, key, by).Result()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range batch {
+			// the bound is inclusive, skip what the previous page already had at the same score
+			if after != nil && !before(redis.Z{Score: after.score, Member: after.id}, entry, options.Descending) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) == limit {
+				return entries, nil
+			}
+		}
+		if len(batch) < limit {
+			return entries, nil
+		}
+		offset += int64(len(batch))
+	}
+}
+
+// ListQueue lists queue items from the indexes
+func ListQueue(options QueueListOptions) (QueueList, error) {
+	ctx := context.Background()
+	list := QueueList{Items: []QueueItem{}}
+	if options.Limit <= 0 {
+		options.Limit = DefaultListLimit
+	}
+	options.Limit = min(options.Limit, MaxListLimit)
+	after, err := parseListCursor(options.Cursor)
+	if err != nil {
+		return list, err
+	}
+
+	keys := []string{indexAllKey}
+	if len(options.Statuses) > 0 {
+		keys = []string{}
+		for _, status := range options.Statuses {
+			keys = append(keys, indexKey(status))
+		}
+	}
+
+	// one extra entry tells whether there is a next page
+	entries := []redis.Z{}
+	for _, key := range keys {
+		page, err := indexPage(ctx, key, options, after, options.Limit+1)
+		if err != nil {
+			return list, err
+		}
+		entries = append(entries, page...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return before(entries[i], entries[j], options.Descending)
+	})
+	if len(entries) > options.Limit {
+		entries = entries[:options.Limit]
+		last := entries[len(entries)-1]
+		list.NextCursor = listCursor{score: last.Score, id: last.Member.(string)}.String()
+	}
+
+	counts := []*redis.IntCmd{}
+	_, err = Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			counts = append(counts, pipe.ZCard(ctx, key))
+		}
+		return nil
+	})
+	if err != nil {
+		return list, err
+	}
+	for _, count := range counts {
+		list.Total += count.Val()
+	}
+
+	if len(entries) == 0 {
+		return list, nil
+	}
+	itemKeys := []string{}
+	for _, entry := range entries {
+		itemKeys = append(itemKeys, "queue:"+entry.Member.(string))
+	}
+	items, err := Redis.MGet(ctx, itemKeys...).Result()
+	if err != nil {
+		return list, err
+	}
+	for i, item := range items {
+		value, ok := item.(string)
+		if !ok {
+			// removed since the index was read
+			continue
+		}
+		var data QueueItem
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			slog.Error("Failed to unmarshal queue item", "key", itemKeys[i], "error", err)
+			continue
+		}
+		list.Items = append(list.Items, data)
+	}
+	return list, nil
+}
@@ -0,0 +1,112 @@
+package encoder
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseListCursor(t *testing.T) {
+	valid := listCursor{score: 1700000000000, id: "video:1"}
+	tests := []struct {
+		name   string
+		value  string
+		want   *listCursor
+		wantOK bool
+	}{
+		{"empty", "", nil, true},
+		{"round trip", valid.String(), &valid, true},
+		{"not base64", "!!", nil, false},
+		{"no separator", encodeCursor("1700000000000"), nil, false},
+		{"score not a number", encodeCursor("abc:video"), nil, false},
+		{"empty id", encodeCursor("1700000000000:"), nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseListCursor(test.value)
+			if (err == nil) != test.wantOK {
+				t.Fatalf("parseListCursor(%q) error = %v", test.value, err)
+			}
+			if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+				t.Fatalf("parseListCursor(%q) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func encodeCursor(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func TestListQueuePaging(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	// several items share a score, the pages have to split them by id
+	fixtures := []struct {
+		id       string
+		queuedAt int64
+		status   Status
+	}{
+		{"a", 1000, Waiting},
+		{"b", 1000, Done},
+		{"c", 1000, Fail},
+		{"d", 2000, Waiting},
+		{"e", 500, Processing},
+		{"f", 1000, Waiting},
+		{"g", 2000, Done},
+	}
+	for _, fixture := range fixtures {
+		item := QueueItem{Id: fixture.id, Status: fixture.status, QueuedAt: time.UnixMilli(fixture.queuedAt)}
+		data, err := json.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Redis.Set(ctx, "queue:"+item.Id, data, 0)
+		indexItem(ctx, Redis, item)
+	}
+
+	tests := []struct {
+		name       string
+		statuses   []Status
+		descending bool
+		want       []string
+	}{
+		{"all ascending", nil, false, []string{"e", "a", "b", "c", "f", "d", "g"}},
+		{"all descending", nil, true, []string{"g", "d", "f", "c", "b", "a", "e"}},
+		{"two statuses ascending", []Status{Waiting, Done}, false, []string{"a", "b", "f", "d", "g"}},
+		{"three statuses descending", []Status{Waiting, Fail, Done}, true, []string{"g", "d", "f", "c", "b", "a"}},
+		{"one status", []Status{Processing}, false, []string{"e"}},
+		{"no items", []Status{Cancelled}, false, []string{}},
+	}
+	for _, test := range tests {
+		for _, limit := range []int{1, 2, 3, 10} {
+			options := QueueListOptions{Statuses: test.statuses, Descending: test.descending, Limit: limit}
+			got := []string{}
+			for pages := 0; ; pages++ {
+				if pages > len(fixtures) {
+					t.Fatalf("%s, limit %d: paging does not end", test.name, limit)
+				}
+				list, err := ListQueue(options)
+				if err != nil {
+					t.Fatalf("%s, limit %d: %v", test.name, limit, err)
+				}
+				if list.Total != int64(len(test.want)) {
+					t.Errorf("%s, limit %d: total = %d, want %d", test.name, limit, list.Total, len(test.want))
+				}
+				for _, item := range list.Items {
+					got = append(got, item.Id)
+				}
+				if list.NextCursor == "" {
+					break
+				}
+				options.Cursor = list.NextCursor
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("%s, limit %d: got %v, want %v", test.name, limit, got, test.want)
+			}
+		}
+	}
+}
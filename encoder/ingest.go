@@ -0,0 +1,160 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goenc/storage"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often download progress is written to the queue item
+const downloadReportInterval = 5 * time.Second
+
+var ingestClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// IsRemoteSource reports whether source is a URL the worker fetches itself instead of a path in storage
+func IsRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "s3://")
+}
+
+// ingestMaxSize is the largest remote source we are willing to download, 0 means unlimited
+func ingestMaxSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("INGEST_MAX_SIZE"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// sourceTypeAllowed rejects content types that are obviously not a video, like an html error page
+func sourceTypeAllowed(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "video/") {
+		return true
+	}
+	switch mediaType {
+	case "application/octet-stream", "binary/octet-stream", "application/mp4", "application/mxf":
+		return true
+	}
+	return false
+}
+
+// progressReader reports how much of a download is done through the step of the queue item
+type progressReader struct {
+	ctx        context.Context
+	reader     io.Reader
+	id         string
+	total      int64
+	read       int64
+	lastReport time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	// stops the download when the job is cancelled
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+	if time.Since(p.lastReport) >= downloadReportInterval {
+		p.lastReport = time.Now()
+		if p.total > 0 {
+			reportStatus(p.id, fmt.Sprintf("downloading_file:%d%%", p.read*100/p.total))
+		} else {
+			reportStatus(p.id, fmt.Sprintf("downloading_file:%dMB", p.read>>20))
+		}
+	}
+	return n, err
+}
+
+// fetchSource copies the source of a job to dst in local storage. Sources are either a path in storage or a remote url.
+func fetchSource(ctx context.Context, id string, source string, dst string) error {
+	if !IsRemoteSource(source) {
+		_, err := storage.Copy(storage.Active(), source, storage.Local, dst)
+		return err
+	}
+
+	var body io.ReadCloser
+	var size int64
+	var contentType string
+	if strings.HasPrefix(source, "s3://") {
+		bucket, key, found := strings.Cut(strings.TrimPrefix(source, "s3://"), "/")
+		if !found || bucket == "" || key == "" {
+			return permanent(errors.New("invalid s3 source, expected s3://bucket/key"))
+		}
+		var err error
+		body, size, contentType, err = storage.OpenS3Object(bucket, key)
+		if err != nil {
+			return err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return err
+		}
+		res, err := ingestClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("source returned status %d", res.StatusCode)
+		}
+		body, size, contentType = res.Body, res.ContentLength, res.Header.Get("Content-Type")
+	}
+	defer body.Close()
+
+	slog.Info("Fetching remote source", "id", id, "source", source, "size", size, "content_type", contentType)
+	if !sourceTypeAllowed(contentType) {
+		return permanent(errors.New("source is not a video, content type " + contentType))
+	}
+	if maxSize := ingestMaxSize(); maxSize > 0 && size > maxSize {
+		return permanent(fmt.Errorf("source is too large, %d bytes exceeds the limit of %d", size, maxSize))
+	}
+
+	var reader io.Reader = &progressReader{ctx: ctx, reader: body, id: id, total: size, lastReport: time.Now()}
+	if maxSize := ingestMaxSize(); maxSize > 0 {
+		// sources without a content length can still be too large
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	writer, err := storage.LocalCreate(dst)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		storage.Abort(writer, err)
+		return err
+	}
+	if maxSize := ingestMaxSize(); maxSize > 0 && written > maxSize {
+		err := permanent(fmt.Errorf("source is too large, exceeds the limit of %d bytes", maxSize))
+		storage.Abort(writer, err)
+		return err
+	}
+	if size > 0 && written != size {
+		err := fmt.Errorf("source was truncated, got %d of %d bytes", written, size)
+		storage.Abort(writer, err)
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,201 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Ladder is a named set of profiles that can be requested instead of listing the profiles
+type Ladder struct {
+	Name     string   `json:"name"`
+	Profiles []string `json:"profiles"`
+}
+
+// DefaultLadders are created the first time the server starts
+var DefaultLadders = []Ladder{
+	{Name: "mobile", Profiles: []string{"144p", "240p", "360p", "480p"}},
+	{Name: "standard", Profiles: []string{"360p", "480p", "720p", "1080p"}},
+	{Name: "premium", Profiles: []string{"480p", "720p", "1080p", "1440p", "2160p"}},
+}
+
+var (
+	ErrLadderNotFound = errors.New("ladder does not exist")
+	ErrLadderExists   = errors.New("ladder already exists")
+)
+
+// ladders are stored in a single hash, name -> json encoded ladder
+const laddersKey = "ladders"
+
+func (l Ladder) validate() error {
+	if !labelPattern.MatchString(l.Name) {
+		return errors.New("name may only contain alphanumeric characters, dashes and underscores")
+	}
+	if len(l.Profiles) == 0 {
+		return errors.New("a ladder needs at least one profile")
+	}
+	seen := map[string]bool{}
+	for _, label := range l.Profiles {
+		if getSizeMapping(label).Label == "" {
+			return fmt.Errorf("unknown profile %s", label)
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate profile %s", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// SeedLadders stores the default ladders, once. Ladders deleted afterwards are not brought back.
+func SeedLadders() {
+	ctx := context.Background()
+	seeded, err := Redis.Exists(ctx, laddersKey+":seeded").Result()
+	if err != nil {
+		slog.Error("Failed to seed ladders", "error", err)
+		return
+	}
+	if seeded > 0 {
+		return
+	}
+	ladders := map[string]string{}
+	for _, ladder := range DefaultLadders {
+		// only keep the profiles that exist in the configured profiles
+		available := []string{}
+		for _, label := range ladder.Profiles {
+			if getSizeMapping(label).Label != "" {
+				available = append(available, label)
+			}
+		}
+		if len(available) == 0 {
+			continue
+		}
+		ladder.Profiles = available
+		data, err := json.Marshal(ladder)
+		if err != nil {
+			slog.Error("Failed to marshal ladder", "name", ladder.Name, "error", err)
+			continue
+		}
+		ladders[ladder.Name] = string(data)
+	}
+	// the flag is only set together with the ladders, so a failed seed is tried again on the next start.
+	// HSETNX keeps ladders another server created in the meantime.
+	_, err = Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for name, data := range ladders {
+			pipe.HSetNX(ctx, laddersKey, name, data)
+		}
+		pipe.Set(ctx, laddersKey+":seeded", "1", 0)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to seed ladders", "error", err)
+	}
+}
+
+func GetLadders() ([]Ladder, error) {
+	data, err := Redis.HGetAll(context.Background(), laddersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	ladders := []Ladder{}
+	for name, item := range data {
+		var ladder Ladder
+		if err := json.Unmarshal([]byte(item), &ladder); err != nil {
+			slog.Error("Failed to unmarshal ladder", "name", name, "error", err)
+			continue
+		}
+		ladders = append(ladders, ladder)
+	}
+	sort.Slice(ladders, func(i, j int) bool {
+		return ladders[i].Name < ladders[j].Name
+	})
+	return ladders, nil
+}
+
+func GetLadder(name string) (Ladder, error) {
+	var ladder Ladder
+	data, err := Redis.HGet(context.Background(), laddersKey, name).Result()
+	if err == redis.Nil {
+		return ladder, ErrLadderNotFound
+	}
+	if err != nil {
+		return ladder, err
+	}
+	err = json.Unmarshal([]byte(data), &ladder)
+	return ladder, err
+}
+
+// SaveLadder creates or replaces a ladder
+func SaveLadder(ladder Ladder) error {
+	if err := ladder.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ladder)
+	if err != nil {
+		return err
+	}
+	return Redis.HSet(context.Background(), laddersKey, ladder.Name, string(data)).Err()
+}
+
+// CreateLadder stores a new ladder, ErrLadderExists when a ladder with the name exists
+func CreateLadder(ladder Ladder) error {
+	if err := ladder.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ladder)
+	if err != nil {
+		return err
+	}
+	created, err := Redis.HSetNX(context.Background(), laddersKey, ladder.Name, string(data)).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrLadderExists
+	}
+	return nil
+}
+
+func DeleteLadder(name string) error {
+	deleted, err := Redis.HDel(context.Background(), laddersKey, name).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrLadderNotFound
+	}
+	return nil
+}
+
+// ResolveProfiles turns either an explicit comma separated profile list or a ladder name into the profile list of a job
+func ResolveProfiles(profiles string, ladder string) (string, error) {
+	if profiles != "" && ladder != "" {
+		return "", errors.New("pass either profiles or ladder, not both")
+	}
+	if ladder != "" {
+		l, err := GetLadder(ladder)
+		if err != nil {
+			return "", err
+		}
+		// profiles can be removed from the profiles file after the ladder was saved
+		if err := l.validate(); err != nil {
+			return "", fmt.Errorf("ladder %s is invalid: %w", ladder, err)
+		}
+		return strings.Join(l.Profiles, ","), nil
+	}
+	if profiles == "" {
+		return "", errors.New("profiles or ladder is required")
+	}
+	for _, label := range strings.Split(profiles, ",") {
+		if getSizeMapping(label).Label == "" {
+			return "", fmt.Errorf("unknown profile %s", label)
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,214 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A claimed job sits in the processing list of its worker and holds a lease, its member in the leases sorted set scored by
+// the unix time in milliseconds the lease expires. The heartbeat renews the leases. Once a lease expires the job is moved
+// back to the queue, so a job is always either queued or claimed.
+// The scripts only touch the keys passed in KEYS.
+const leasesKey = "leases"
+
+const (
+	leaseTTL = 35 * time.Second
+	// how long a worker waits for a job to be queued before it looks at the queues again
+	claimWaitTimeout = 5 * time.Second
+	// how long a worker waits after claiming failed
+	claimRetryDelay     = 1 * time.Second
+	leaseRecoveryPeriod = 30 * time.Second
+)
+
+// ErrLeaseExpired is the failure of a job whose worker stopped while processing it
+var ErrLeaseExpired = errors.New("worker stopped while processing the job, its lease expired")
+
+func processingKey(workerID string) string {
+	return "processing:" + workerID
+}
+
+// claimScript takes the first job of the first non empty queue in KEYS, moves it into the processing list
+// (the second to last key) and takes its lease in the leases set (the last key) in one step
+var claimScript = redis.NewScript(`
+for i = 1, #KEYS - 2 do
+	local popped = redis.call('ZPOPMIN', KEYS[i])
+	if popped[1] then
+		redis.call('RPUSH', KEYS[#KEYS - 1], popped[1])
+		redis.call('ZADD', KEYS[#KEYS], ARGV[1], popped[1])
+		return popped[1]
+	end
+end
+return false
+`)
+
+// reclaimScript moves a job from a processing list back to its queue, unless its lease was renewed in the meantime
+var reclaimScript = redis.NewScript(`
+local expires = redis.call('ZSCORE', KEYS[3], ARGV[1])
+if expires and tonumber(expires) > tonumber(ARGV[3]) then
+	return 0
+end
+if redis.call('LREM', KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+redis.call('LPUSH', KEYS[4], '1')
+redis.call('LTRIM', KEYS[4], 0, ARGV[4] - 1)
+return 1
+`)
+
+func leaseExpiry(now time.Time) float64 {
+	return float64(now.Add(leaseTTL).UnixMilli())
+}
+
+// claimJob claims the next job for this worker from queues, waiting until there is one
+func claimJob(ctx context.Context, queues []workerQueue) (string, error) {
+	ready := []string{}
+	for _, queue := range queues {
+		ready = append(ready, readyKey(queue.Name))
+	}
+	for {
+		keys := append(queueOrder(queues), processingKey(WorkerID), leasesKey)
+		id, err := claimScript.Run(ctx, Redis, keys, leaseExpiry(time.Now())).Text()
+		if err == nil {
+			return id, nil
+		}
+		if err != redis.Nil {
+			return "", err
+		}
+		// sleep until a job is queued in one of the queues, the timeout catches jobs queued without a notification
+		err = Redis.BLPop(ctx, claimWaitTimeout, ready...).Err()
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+}
+
+// renewLeases extends the leases of all jobs this worker holds
+func renewLeases(ctx context.Context) {
+	ids, err := Redis.LRange(ctx, processingKey(WorkerID), 0, -1).Result()
+	if err != nil {
+		slog.Error("Failed to list claimed jobs", "error", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	leases := []*redis.Z{}
+	for _, id := range ids {
+		leases = append(leases, &redis.Z{Score: leaseExpiry(time.Now()), Member: id})
+	}
+	// only existing leases, a lease that expired meanwhile belongs to a job that was requeued
+	Redis.ZAddXX(ctx, leasesKey, leases...)
+}
+
+// releaseJob gives up the claim on a finished job
+func releaseJob(ctx context.Context, id string) {
+	_, err := Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingKey(WorkerID), 0, id)
+		pipe.ZRem(ctx, leasesKey, id)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to release job", "id", id, "error", err)
+	}
+}
+
+// delayJob gives up the claim on a job and parks it in the delayed set until its retry is due
+func delayJob(ctx context.Context, id string, at time.Time) {
+	_, err := Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingKey(WorkerID), 0, id)
+		pipe.ZRem(ctx, leasesKey, id)
+		pipe.ZAdd(ctx, delayedKey, &redis.Z{Score: float64(at.UnixMilli()), Member: id})
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to delay job", "id", id, "error", err)
+	}
+}
+
+// RecoverExpiredLeases puts jobs whose lease expired, because their worker died, back in the queue
+func RecoverExpiredLeases() {
+	ctx := context.Background()
+	iter := Redis.Scan(ctx, 0, "processing:*", 0).Iterator()
+	for iter.Next(ctx) {
+		list := iter.Val()
+		ids, err := Redis.LRange(ctx, list, 0, -1).Result()
+		if err != nil {
+			slog.Error("Failed to list claimed jobs", "list", list, "error", err)
+			continue
+		}
+		for _, id := range ids {
+			var data QueueItem
+			item, err := Redis.Get(ctx, "queue:"+id).Result()
+			if err == nil {
+				err = json.Unmarshal([]byte(item), &data)
+			}
+			if err == redis.Nil || (err == nil && data.Status != Processing && data.Status != Waiting) {
+				// the worker died after finishing the job, only the claim is left
+				Redis.LRem(ctx, list, 0, id)
+				continue
+			}
+			if err != nil {
+				slog.Error("Failed to get queue item", "id", id, "error", err)
+				continue
+			}
+
+			keys := []string{list, queueKey(data.queueName()), leasesKey, readyKey(data.queueName())}
+			now := time.Now()
+			moved, err := reclaimScript.Run(ctx, Redis, keys, id, queueScore(data.Priority, now), now.UnixMilli(), readyListSize).Int()
+			if err != nil {
+				slog.Error("Failed to recover job", "id", id, "error", err)
+				continue
+			}
+			if moved == 0 {
+				continue
+			}
+			worker := strings.TrimPrefix(list, "processing:")
+			slog.Info("Lease expired, requeueing job", "id", id, "worker_id", worker)
+			var failed *QueueItem
+			err = UpdateQueueItem(id, func(data *QueueItem) error {
+				failed = nil
+				if data.Status != Processing && data.Status != Waiting {
+					return errSkipUpdate
+				}
+				// the job is back in the queue already, another worker may have started it since
+				if data.Status == Processing && data.WorkerID != worker {
+					return errSkipUpdate
+				}
+				attempts := data.Attempts + 1
+				if attempts < retry.MaxAttempts {
+					setStatus(data, Waiting, attempts, "")
+					return nil
+				}
+				// a job that keeps killing its worker fails for good like any other
+				failedAt := time.Now()
+				setStatus(data, Fail, attempts, "")
+				data.LastError = ErrLeaseExpired.Error()
+				data.FailedAt = &failedAt
+				failed = data
+				return nil
+			})
+			if err != nil {
+				slog.Error("Failed to update requeued job", "id", id, "error", err)
+				continue
+			}
+			if failed != nil {
+				slog.Error("Job failed for good", "id", id, "attempts", failed.Attempts, "worker_id", worker)
+				buryJob(ctx, worker, *failed, ErrLeaseExpired)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("Failed to scan processing lists", "error", err)
+	}
+}
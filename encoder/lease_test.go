@@ -0,0 +1,148 @@
+package encoder
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// useTestRedis points Redis at an in-memory server for the duration of the test
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	m := miniredis.RunT(t)
+	Redis = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	return m
+}
+
+func storeTestItem(t *testing.T, item QueueItem) {
+	t.Helper()
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Redis.Set(context.Background(), "queue:"+item.Id, data, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimScript(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	Redis.ZAdd(ctx, queueKey("bulk"), &redis.Z{Score: 1, Member: "bulk-1"})
+	Redis.ZAdd(ctx, queueKey(DefaultQueue), &redis.Z{Score: 2, Member: "late"}, &redis.Z{Score: 1, Member: "early"})
+	keys := []string{queueKey("urgent"), queueKey(DefaultQueue), queueKey("bulk"), processingKey("w1"), leasesKey}
+
+	// the empty queue is skipped, the first job of the next queue is taken
+	for _, want := range []string{"early", "late", "bulk-1"} {
+		id, err := claimScript.Run(ctx, Redis, keys, 1000).Text()
+		if err != nil || id != want {
+			t.Fatalf("claim = %q, %v, want %q", id, err, want)
+		}
+	}
+	if _, err := claimScript.Run(ctx, Redis, keys, 1000).Text(); err != redis.Nil {
+		t.Fatalf("claim from empty queues = %v, want redis.Nil", err)
+	}
+
+	claimed := Redis.LRange(ctx, processingKey("w1"), 0, -1).Val()
+	if !slices.Equal(claimed, []string{"early", "late", "bulk-1"}) {
+		t.Errorf("processing list = %v", claimed)
+	}
+	for _, id := range claimed {
+		if expires, err := Redis.ZScore(ctx, leasesKey, id).Result(); err != nil || expires != 1000 {
+			t.Errorf("lease of %s = %v, %v, want 1000", id, expires, err)
+		}
+	}
+}
+
+func TestReclaimScript(t *testing.T) {
+	tests := []struct {
+		name        string
+		claimed     bool
+		lease       float64 // 0 for no lease
+		wantMoved   int
+		wantQueued  bool
+		wantClaimed bool
+	}{
+		{"lease expired", true, 500, 1, true, false},
+		{"lease missing", true, 0, 1, true, false},
+		{"lease renewed", true, 2000, 0, false, true},
+		{"released meanwhile", false, 0, 0, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRedis(t)
+			ctx := context.Background()
+			if test.claimed {
+				Redis.RPush(ctx, processingKey("w1"), "job")
+			}
+			if test.lease > 0 {
+				Redis.ZAdd(ctx, leasesKey, &redis.Z{Score: test.lease, Member: "job"})
+			}
+			keys := []string{processingKey("w1"), queueKey(DefaultQueue), leasesKey, readyKey(DefaultQueue)}
+			moved, err := reclaimScript.Run(ctx, Redis, keys, "job", 5, 1000, readyListSize).Int()
+			if err != nil || moved != test.wantMoved {
+				t.Fatalf("reclaim = %d, %v, want %d", moved, err, test.wantMoved)
+			}
+			_, err = Redis.ZScore(ctx, queueKey(DefaultQueue), "job").Result()
+			if queued := err == nil; queued != test.wantQueued {
+				t.Errorf("queued = %v, want %v", queued, test.wantQueued)
+			}
+			if claimed := Redis.LLen(ctx, processingKey("w1")).Val() > 0; claimed != test.wantClaimed {
+				t.Errorf("claimed = %v, want %v", claimed, test.wantClaimed)
+			}
+			if woken := Redis.LLen(ctx, readyKey(DefaultQueue)).Val() > 0; woken != test.wantQueued {
+				t.Errorf("ready notification = %v, want %v", woken, test.wantQueued)
+			}
+			if test.wantMoved == 1 && Redis.ZScore(ctx, leasesKey, "job").Err() != redis.Nil {
+				t.Errorf("lease of the requeued job was kept")
+			}
+		})
+	}
+}
+
+func TestRecoverExpiredLeases(t *testing.T) {
+	WorkerID = "w2"
+	tests := []struct {
+		name         string
+		item         QueueItem
+		wantStatus   Status
+		wantWorker   string
+		wantAttempts int
+	}{
+		{"dead worker's job is requeued", QueueItem{Id: "job", Status: Processing, WorkerID: "w1"}, Waiting, "", 1},
+		{"claimed but not started", QueueItem{Id: "job", Status: Waiting}, Waiting, "", 1},
+		// another worker started the job after it went back into the queue, before its status was updated
+		{"started by another worker", QueueItem{Id: "job", Status: Processing, WorkerID: "w2"}, Processing, "w2", 0},
+		{"out of attempts", QueueItem{Id: "job", Status: Processing, WorkerID: "w1", Attempts: retry.MaxAttempts - 1}, Fail, "", retry.MaxAttempts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRedis(t)
+			ctx := context.Background()
+			storeTestItem(t, test.item)
+			Redis.RPush(ctx, processingKey("w1"), "job")
+			Redis.ZAdd(ctx, leasesKey, &redis.Z{Score: float64(time.Now().Add(-time.Minute).UnixMilli()), Member: "job"})
+
+			RecoverExpiredLeases()
+
+			item, err := GetQueueItem(ctx, "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.Status != test.wantStatus || item.WorkerID != test.wantWorker || item.Attempts != test.wantAttempts {
+				t.Errorf("item = %s by %q with %d attempts, want %s by %q with %d attempts",
+					item.Status, item.WorkerID, item.Attempts, test.wantStatus, test.wantWorker, test.wantAttempts)
+			}
+			queued := Redis.ZScore(ctx, queueKey(DefaultQueue), "job").Err() == nil
+			dead := Redis.Exists(ctx, deadKey("job")).Val() == 1
+			if wantDead := test.wantStatus == Fail; queued == wantDead || dead != wantDead {
+				t.Errorf("queued = %v, dead = %v, want the job dead = %v", queued, dead, wantDead)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/bsm/redislock"
+)
+
+// lock:encode:{id} is held while a video is encoded, so only one worker at a time writes under {id}/.
+// The lock is refreshed while the encode runs and expires when its worker dies.
+const (
+	encodeLockTTL     = 30 * time.Second
+	encodeLockRefresh = 10 * time.Second
+	// a job whose video is locked by another worker is tried again after this delay, without using up an attempt
+	encodeLockedRetryDelay = 30 * time.Second
+)
+
+var (
+	ErrEncodeLocked = errors.New("video is being encoded by another worker")
+	ErrLockLost     = errors.New("lost the encode lock of the video")
+)
+
+func encodeLockKey(id string) string {
+	return "lock:encode:" + id
+}
+
+type encodeLock struct {
+	id     string
+	lock   *redislock.Lock
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// lockEncode takes the encode lock of a video. The returned context is cancelled with ErrLockLost
+// when the lock can't be refreshed, which stops ffmpeg.
+func lockEncode(ctx context.Context, id string) (*encodeLock, context.Context, error) {
+	lock, err := redislock.New(Redis).Obtain(ctx, encodeLockKey(id), encodeLockTTL, &redislock.Options{Metadata: WorkerID})
+	if err == redislock.ErrNotObtained {
+		return nil, ctx, ErrEncodeLocked
+	}
+	if err != nil {
+		return nil, ctx, err
+	}
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	l := &encodeLock{id: id, lock: lock, cancel: cancel, done: make(chan struct{})}
+	go l.refresh(lockCtx)
+	return l, lockCtx, nil
+}
+
+func (l *encodeLock) refresh(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(encodeLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.lock.Refresh(ctx, encodeLockTTL, nil)
+		if err == redislock.ErrNotObtained {
+			slog.Error("Encode lock lost, stopping", "id", l.id)
+			l.cancel(ErrLockLost)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			// the lock is only lost once it expires, try again on the next tick
+			slog.Warn("Failed to refresh encode lock", "id", l.id, "error", err)
+		}
+	}
+}
+
+// check returns ErrLockLost unless the lock is still held
+func (l *encodeLock) check(ctx context.Context) error {
+	ttl, err := l.lock.TTL(ctx)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// release stops refreshing the lock and gives it up
+func (l *encodeLock) release() {
+	l.cancel(nil)
+	<-l.done
+	if err := l.lock.Release(context.Background()); err != nil && err != redislock.ErrLockNotHeld {
+		slog.Warn("Failed to release encode lock", "id", l.id, "error", err)
+	}
+}
@@ -1,6 +1,7 @@
 package encoder
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,41 +14,159 @@ import (
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
-type SizeMappingType struct {
-	Label        string
-	Scale        string
-	VideoBitrate string
-	AudioBitrate string
-	Bufsize      string
-	Crf          string
+func reportStatus(id string, status string) {
+	slog.Info("Status update", "id", id, "status", status)
+	if err := modifyClaimedQueueItem(id, Processing, 0, status); err != nil {
+		slog.Warn("Failed to update status", "id", id, "status", status, "error", err)
+	}
+}
+
+// videoArgs are the ffmpeg output options for the video stream of a rendition
+func videoArgs(sm SizeMappingType) ffmpeg.KwArgs {
+	args := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{videoCodecs[sm.Codec].speedArgs(sm.Preset), sm.rateArgs(), {
+		"c:v": sm.Codec,
+		"vf": fmt.Sprintf(
+			"scale=w=%d:h=%d:force_original_aspect_ratio=decrease:force_divisible_by=2",
+			sm.Width,
+			sm.Height,
+		),
+	}})
+	if sm.GOP > 0 {
+		// fixed keyframe interval so segments line up across renditions
+		args["g"] = strconv.Itoa(sm.GOP)
+		args["keyint_min"] = strconv.Itoa(sm.GOP)
+		args["sc_threshold"] = "0"
+	}
+	return args
+}
+
+// audioArgs are the ffmpeg output options for the audio stream of a rendition
+func audioArgs(sm SizeMappingType) ffmpeg.KwArgs {
+	args := ffmpeg.KwArgs{
+		"c:a": sm.AudioCodec,
+		"b:a": sm.AudioBitrate,
+	}
+	if sm.AudioChannels > 0 {
+		args["ac"] = strconv.Itoa(sm.AudioChannels)
+	}
+	return args
 }
 
-var SizeMapping []SizeMappingType = []SizeMappingType{
-	{"2160p", "3840:2160", "12000k", "192k", "18000k", "18"},
-	{"1440p", "2560:1440", "8000k", "160k", "12000k", "19"},
-	{"1080p", "1920:1080", "5000k", "160k", "8000k", "20"},
-	{"720p", "1280:720", "2500k", "128k", "4000k", "22"},
-	{"480p", "854:480", "1200k", "96k", "2000k", "23"},
-	{"360p", "640:360", "800k", "96k", "1500k", "24"},
-	{"240p", "426:240", "500k", "64k", "1000k", "25"},
-	{"144p", "256:144", "300k", "64k", "600k", "26"},
+// hlsArgs are the ffmpeg output options for an fMP4 HLS rendition written to dir
+func hlsArgs(dir string) ffmpeg.KwArgs {
+	return ffmpeg.KwArgs{
+		"hls_time":             "4",
+		"hls_playlist_type":    "vod",
+		"hls_segment_type":     "fmp4",
+		"hls_segment_filename": dir + "/seg_%03d.m4s",
+	}
+}
+
+// moveToStorage streams a file from local tmp storage to the final storage and removes the local copy
+func moveToStorage(src string, dst string) error {
+	if _, err := storage.Copy(storage.Local, src, storage.Active(), dst); err != nil {
+		return err
+	}
+	return storage.LocalFileDelete(src)
+}
+
+// encodeRendition encodes one rendition in its own ffmpeg run(s) into tmp/{id}/{label}
+func encodeRendition(ctx context.Context, id string, local_input string, hwaccel string, sm SizeMappingType, progress *encodeProgress) error {
+	outputDir := "tmp/" + id + "/" + sm.Label
+	codec := videoCodecs[sm.Codec]
+	passlogfile := fmt.Sprintf(storage.LocalStoragePath+"/%s/logfile", outputDir)
+
+	// First pass (bitrate analysis)
+	if sm.twoPass() {
+		reportStatus(id, "first_pass_ready:"+sm.Label)
+		pass1Args := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{videoArgs(sm), codec.passArgs(1, passlogfile), {
+			"an": "",    // disable audio for first pass
+			"f":  "mp4", // required for /dev/null replacement
+		}})
+		pass1 := ffmpeg.Input(local_input, ffmpeg.KwArgs{
+			"hwaccel": hwaccel,
+		}).
+			Output("/dev/null", pass1Args).OverWriteOutput()
+
+		slog.Info("Encoding first pass", "resolution", sm.Label, "codec", sm.Codec)
+		reportStatus(id, "encoding_first_pass:"+sm.Label)
+		if err := progress.run(ctx, pass1); err != nil {
+			slog.Error("Failed to encode first pass", "resolution", sm.Label, "error", err)
+			reportStatus(id, "error_first_pass:"+sm.Label)
+			return err
+		}
+	}
+
+	// Second pass (generate HLS)
+	reportStatus(id, "second_pass_ready:"+sm.Label)
+	pass2Args := ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{videoArgs(sm), audioArgs(sm), hlsArgs(storage.LocalStoragePath + "/" + outputDir)})
+	if sm.twoPass() {
+		pass2Args = ffmpeg.MergeKwArgs([]ffmpeg.KwArgs{pass2Args, codec.passArgs(2, passlogfile)})
+	}
+	pass2 := ffmpeg.Input(local_input, ffmpeg.KwArgs{
+		"hwaccel": hwaccel,
+	}).
+		Output(fmt.Sprintf(storage.LocalStoragePath+"/%s/index.m3u8", outputDir), pass2Args).OverWriteOutput()
+
+	slog.Info("Encoding second pass", "resolution", sm.Label, "codec", sm.Codec, "rate_control", sm.RateControl)
+	reportStatus(id, "encoding_second_pass:"+sm.Label)
+	if err := progress.run(ctx, pass2); err != nil {
+		slog.Error("Failed to encode second pass", "resolution", sm.Label, "error", err)
+		reportStatus(id, "error_second_pass:"+sm.Label)
+		return err
+	}
+	return nil
 }
 
-func getSizeMapping(size string) SizeMappingType {
-	for _, sm := range SizeMapping {
-		if sm.Label == size {
-			return sm
+// finishRendition measures an encoded rendition and moves it from tmp to the final storage
+func finishRendition(id string, sm SizeMappingType) (rendition, error) {
+	outputDir := "tmp/" + id + "/" + sm.Label
+
+	reportStatus(id, "measuring_output:"+sm.Label)
+	measured, err := measureRendition(storage.LocalStoragePath+"/"+outputDir, sm)
+	if err != nil {
+		slog.Error("Failed to measure output", "resolution", sm.Label, "error", err)
+		reportStatus(id, "error_measure_output:"+sm.Label)
+		return measured, err
+	}
+
+	// Move files from temp to final storage
+	reportStatus(id, "moving_files:"+sm.Label)
+	files, err := storage.LocalDirectoryListing(outputDir, false, false)
+	if err != nil {
+		reportStatus(id, "error_move_files:"+sm.Label)
+		return measured, err
+	}
+	for _, file := range files {
+		src := outputDir + "/" + file
+		dst := id + "/" + sm.Label + "/" + file
+		if err := moveToStorage(src, dst); err != nil {
+			reportStatus(id, "error_file_put:"+sm.Label)
+			return measured, err
 		}
+		slog.Debug("Moved file to final storage", "src", src, "dst", dst)
 	}
-	return SizeMappingType{}
+
+	reportStatus(id, "finished_size:"+sm.Label)
+	return measured, nil
 }
 
-func reportStatus(id string, status string) {
-	slog.Info("Status update", "id", id, "status", status)
-	ModifyQueueItem(id, Processing, 0, status)
+// EncodeFile encodes input into the renditions in sizes, callbackURL is kept in meta.json for the deleted webhook. Cancelling ctx stops the download or kills ffmpeg, returning ctx.Err().
+// The encode lock of the video is held throughout, ErrEncodeLocked is returned when another worker holds it.
+func EncodeFile(ctx context.Context, input string, id string, sizes string, callbackURL string) error {
+	lock, lockCtx, err := lockEncode(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	err = encodeFile(lockCtx, lock, input, id, sizes, callbackURL)
+	if err != nil && errors.Is(context.Cause(lockCtx), ErrLockLost) {
+		return ErrLockLost
+	}
+	return err
 }
 
-func EncodeFile(input string, id string, sizes string) error {
+func encodeFile(ctx context.Context, lock *encodeLock, input string, id string, sizes string, callbackURL string) error {
 	reportStatus(id, "starting")
 
 	reportStatus(id, "parsing_sizes")
@@ -55,12 +174,14 @@ func EncodeFile(input string, id string, sizes string) error {
 	sizeList := strings.Split(sizes, ",")
 
 	// check if all sizes are valid
+	var renditions []SizeMappingType
 	for _, s := range sizeList {
 		reportStatus(id, "preparing_size:"+s)
 		sm := getSizeMapping(s)
 		if sm.Label == "" {
-			return errors.New("invalid size: " + s)
+			return permanent(errors.New("invalid size: " + s))
 		}
+		renditions = append(renditions, sm)
 	}
 
 	//if a folder with the same name already exists, check if it has a meta.json file. if not, delete the folder and start over
@@ -74,140 +195,113 @@ func EncodeFile(input string, id string, sizes string) error {
 		return nil
 	}
 
-	var masterPlaylist strings.Builder
-	masterPlaylist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
-
 	reportStatus(id, "creating_directories")
 	storage.LocalDirectoryCreate("tmp/" + id)
 	storage.DirectoryCreate(id)
 
 	reportStatus(id, "downloading_file")
-	file, err := storage.FileGet(input, true)
-	if err != nil {
+	if err := fetchSource(ctx, id, input, "tmp/"+id+"/"+"input"); err != nil {
+		slog.Error("Failed to download source", "id", id, "source", input, "error", err)
 		reportStatus(id, "error_downloading_file")
 		return err
 	}
 
 	reportStatus(id, "file_downloaded")
-	storage.LocalFilePut("tmp/"+id+"/"+"input", *file.Data)
 
 	local_input := os.Getenv("LOCAL_STORAGE_PATH") + "/tmp/" + id + "/" + "input"
 
-	for _, s := range sizeList {
-		sm := getSizeMapping(s)
-		outputDir := "tmp/" + id + "/" + sm.Label
-		reportStatus(id, "creating_output_dir:"+sm.Label)
-		storage.LocalDirectoryCreate(outputDir)
-
-		sm.Scale = strings.ReplaceAll(sm.Scale, ":", "x") // for master playlist
-
-		hwaccel := os.Getenv("FFMPEG_HARDWARE_ACCEL")
-		if hwaccel != "" {
-			slog.Info("Using hardware acceleration", "hwaccel", hwaccel)
+	reportStatus(id, "probing_source")
+	source, err := probeSource(local_input)
+	if err != nil {
+		slog.Error("Failed to probe source", "id", id, "error", err)
+		if errors.Is(err, ErrNotAVideo) {
+			reportStatus(id, "error_not_a_video")
 		} else {
-			hwaccel = "none"
+			reportStatus(id, "error_probe_failed")
 		}
+		return err
+	}
+	slog.Info("Probed source", "id", id, "source", source)
 
-		// First pass (bitrate analysis)
-		reportStatus(id, "first_pass_ready:"+sm.Label)
-		pass1 := ffmpeg.Input(local_input, ffmpeg.KwArgs{
-			"hwaccel": hwaccel,
-		}).
-			Output("/dev/null", ffmpeg.KwArgs{
-				"c:v":     "libx264",
-				"preset":  "slow",
-				"b:v":     sm.VideoBitrate, // bitrate mode
-				"maxrate": sm.VideoBitrate,
-				"bufsize": sm.Bufsize,
-				"vf": fmt.Sprintf(
-					"scale=w=%s:h=%s:force_original_aspect_ratio=decrease:force_divisible_by=2",
-					strings.Split(sm.Scale, "x")[0],
-					strings.Split(sm.Scale, "x")[1],
-				),
-				"c:a":         "aac",
-				"b:a":         sm.AudioBitrate,
-				"pass":        "1",
-				"an":          "",    // disable audio for first pass
-				"f":           "mp4", // required for /dev/null replacement
-				"passlogfile": fmt.Sprintf(storage.LocalStoragePath+"/%s/logfile", outputDir),
-			}).OverWriteOutput()
-
-		slog.Info("Encoding first pass", "resolution", sm.Label)
-		reportStatus(id, "encoding_first_pass:"+sm.Label)
-		if err := pass1.Run(); err != nil {
-			slog.Error("Failed to encode first pass", "resolution", sm.Label, "error", err)
-			reportStatus(id, "error_first_pass:"+sm.Label)
-			return err
-		}
+	// never upscale
+	renditions, skipped := fitRenditions(renditions, source)
+	if len(skipped) > 0 {
+		slog.Info("Skipping renditions above source resolution", "id", id, "skipped", skipped)
+	}
 
-		// Second pass (generate HLS)
-		reportStatus(id, "second_pass_ready:"+sm.Label)
-		pass2 := ffmpeg.Input(local_input, ffmpeg.KwArgs{
-			"hwaccel": hwaccel,
-		}).
-			Output(fmt.Sprintf(storage.LocalStoragePath+"/%s/index.m3u8", outputDir), ffmpeg.KwArgs{
-				"c:v":     "libx264",
-				"preset":  "slow",
-				"b:v":     sm.VideoBitrate, // bitrate mode
-				"maxrate": sm.VideoBitrate,
-				"bufsize": sm.Bufsize,
-				"vf": fmt.Sprintf(
-					"scale=w=%s:h=%s:force_original_aspect_ratio=decrease:force_divisible_by=2",
-					strings.Split(sm.Scale, "x")[0],
-					strings.Split(sm.Scale, "x")[1],
-				),
-				"c:a":                  "aac",
-				"b:a":                  sm.AudioBitrate,
-				"hls_time":             "4",
-				"hls_playlist_type":    "vod",
-				"hls_segment_type":     "fmp4",
-				"hls_segment_filename": fmt.Sprintf(storage.LocalStoragePath+"/%s/seg_%%03d.m4s", outputDir),
-				"pass":                 "2",
-				"passlogfile":          fmt.Sprintf(storage.LocalStoragePath+"/%s/logfile", outputDir),
-			}).OverWriteOutput()
-
-		slog.Info("Encoding second pass", "resolution", sm.Label)
-		reportStatus(id, "encoding_second_pass:"+sm.Label)
-		if err := pass2.Run(); err != nil {
-			slog.Error("Failed to encode second pass", "resolution", sm.Label, "error", err)
-			reportStatus(id, "error_second_pass:"+sm.Label)
-			return err
-		}
+	sizeList = []string{}
+	for _, sm := range renditions {
+		sizeList = append(sizeList, sm.Label)
+		reportStatus(id, "creating_output_dir:"+sm.Label)
+		storage.LocalDirectoryCreate("tmp/" + id + "/" + sm.Label)
+	}
+
+	hwaccel := os.Getenv("FFMPEG_HARDWARE_ACCEL")
+	if hwaccel != "" {
+		slog.Info("Using hardware acceleration", "hwaccel", hwaccel)
+	} else {
+		hwaccel = "none"
+	}
 
-		// Move files from temp to final storage
-		reportStatus(id, "moving_files:"+sm.Label)
-		files, err := storage.LocalDirectoryListing(outputDir, false, false)
-		if err != nil {
-			reportStatus(id, "error_move_files:"+sm.Label)
+	var encoded []rendition
+	if encodeMode() == EncodeModeCombined {
+		progress := newEncodeProgress(id, source.Duration, combinedRuns(renditions))
+		if err := encodeCombined(ctx, id, local_input, hwaccel, renditions, source.AudioCodec != "", progress); err != nil {
 			return err
 		}
-		for _, file := range files {
-			src := outputDir + "/" + file
-			dst := id + "/" + sm.Label + "/" + file
-			file, err := storage.LocalFileGet(src)
+		for _, sm := range renditions {
+			measured, err := finishRendition(id, sm)
 			if err != nil {
-				reportStatus(id, "error_file_get:"+sm.Label)
 				return err
 			}
-			if err := storage.FilePut(dst, file); err != nil {
-				reportStatus(id, "error_file_put:"+sm.Label)
+			encoded = append(encoded, measured)
+		}
+	} else {
+		runs := 0
+		for _, sm := range renditions {
+			runs++
+			if sm.twoPass() {
+				runs++
+			}
+		}
+		progress := newEncodeProgress(id, source.Duration, runs)
+		// finish every rendition before starting the next so tmp only holds one at a time
+		for _, sm := range renditions {
+			if err := encodeRendition(ctx, id, local_input, hwaccel, sm, progress); err != nil {
+				return err
+			}
+			measured, err := finishRendition(id, sm)
+			if err != nil {
 				return err
 			}
-			storage.LocalFileDelete(src)
-			slog.Debug("Moved file to final storage", "src", src, "dst", dst)
+			encoded = append(encoded, measured)
 		}
-
-		// Update master playlist
-		masterPlaylist.WriteString(fmt.Sprintf(
-			"#EXT-X-STREAM-INF:BANDWIDTH=%s,RESOLUTION=%s\n/%s\n",
-			sm.VideoBitrate, sm.Scale, sm.Label,
-		))
-		reportStatus(id, "finished_size:"+sm.Label)
 	}
 
 	// Write master playlist
 	reportStatus(id, "writing_master_playlist")
-	storage.FilePut(id+"/master.m3u8", []byte(masterPlaylist.String()))
+	masterPlaylist, err := buildMasterPlaylist(encoded)
+	if err != nil {
+		slog.Error("Invalid master playlist", "id", id, "error", err)
+		reportStatus(id, "error_master_playlist")
+		return err
+	}
+	if err := storage.FilePut(id+"/master.m3u8", []byte(masterPlaylist)); err != nil {
+		reportStatus(id, "error_master_playlist")
+		return err
+	}
+
+	// Write DASH manifest, referencing the same segments
+	reportStatus(id, "writing_dash_manifest")
+	dashManifest, err := buildDashManifest(encoded)
+	if err != nil {
+		reportStatus(id, "error_dash_manifest")
+		return err
+	}
+	if err := storage.FilePut(id+"/manifest.mpd", dashManifest); err != nil {
+		reportStatus(id, "error_dash_manifest")
+		return err
+	}
 
 	//make imgs dir
 	reportStatus(id, "creating_thumbnails")
@@ -224,7 +318,7 @@ func EncodeFile(input string, id string, sizes string) error {
 			},
 		).OverWriteOutput()
 
-	err = cmd.Run()
+	err = runFFmpeg(ctx, cmd, nil)
 	if err != nil {
 		reportStatus(id, "error_thumbnail")
 		return err
@@ -232,14 +326,7 @@ func EncodeFile(input string, id string, sizes string) error {
 
 	//move the thumbnail to the final storage
 	reportStatus(id, "moving_thumbnail")
-	thumbnailData, err := storage.LocalFileGet("tmp/" + id + "/imgs/thumbnail.jpg")
-	if err != nil {
-		return err
-	}
-	if err := storage.FilePut(id+"/imgs/thumbnail.jpg", thumbnailData); err != nil {
-		return err
-	}
-	if err := storage.LocalFileDelete("tmp/" + id + "/imgs/thumbnail.jpg"); err != nil {
+	if err := moveToStorage("tmp/"+id+"/imgs/thumbnail.jpg", id+"/imgs/thumbnail.jpg"); err != nil {
 		return err
 	}
 
@@ -260,7 +347,7 @@ func EncodeFile(input string, id string, sizes string) error {
 			},
 		).OverWriteOutput()
 
-	err = cmd.Run()
+	err = runFFmpeg(ctx, cmd, nil)
 	if err != nil {
 		reportStatus(id, "error_preview")
 		return err
@@ -294,19 +381,11 @@ func EncodeFile(input string, id string, sizes string) error {
 	//move the previews to the final storage
 	reportStatus(id, "moving_previews")
 	for _, preview := range previews {
-		file, err := storage.LocalFileGet("tmp/" + id + "/imgs/prev-" + strconv.Itoa(preview.Id) + ".jpg")
-		if err != nil {
-			reportStatus(id, "error_preview_file_get")
-			return err
-		}
-		if err := storage.FilePut(id+"/imgs/prev-"+strconv.Itoa(preview.Id)+".jpg", file); err != nil {
+		name := "prev-" + strconv.Itoa(preview.Id) + ".jpg"
+		if err := moveToStorage("tmp/"+id+"/imgs/"+name, id+"/imgs/"+name); err != nil {
 			reportStatus(id, "error_preview_file_put")
 			return err
 		}
-		if err := storage.LocalFileDelete("tmp/" + id + "/imgs/prev-" + strconv.Itoa(preview.Id) + ".jpg"); err != nil {
-			reportStatus(id, "error_preview_file_delete")
-			return err
-		}
 	}
 
 	//write previews
@@ -320,13 +399,19 @@ func EncodeFile(input string, id string, sizes string) error {
 
 	slog.Info("Thumbnails and previews done", "id", id)
 	meta := struct {
-		ID    string   `json:"id"`
-		Sizes []string `json:"sizes"`
-		File  string   `json:"file"`
+		ID           string     `json:"id"`
+		Sizes        []string   `json:"sizes"`
+		SkippedSizes []string   `json:"skipped_sizes,omitempty"`
+		File         string     `json:"file"`
+		Source       SourceInfo `json:"source"`
+		CallbackURL  string     `json:"callback_url,omitempty"`
 	}{
-		ID:    id,
-		Sizes: sizeList,
-		File:  input,
+		ID:           id,
+		Sizes:        sizeList,
+		SkippedSizes: skipped,
+		File:         input,
+		Source:       source,
+		CallbackURL:  callbackURL,
 	}
 	reportStatus(id, "writing_meta_json")
 	metaJson, err := json.MarshalIndent(meta, "", "  ")
@@ -334,15 +419,26 @@ func EncodeFile(input string, id string, sizes string) error {
 		reportStatus(id, "error_meta_json")
 		return err
 	}
-	storage.FilePut(metaPath, metaJson)
+	//only the holder of the lock may publish the video
+	if err := lock.check(ctx); err != nil {
+		reportStatus(id, "error_lock_lost")
+		return err
+	}
+	if err := storage.FilePut(metaPath, metaJson); err != nil {
+		slog.Error("Failed to write meta file", "id", id, "error", err)
+		reportStatus(id, "error_meta_json")
+		return err
+	}
 	slog.Info("Meta file written", "id", id)
 
 	//remove tmp dir
 	reportStatus(id, "cleanup")
 	storage.LocalDirectoryDelete("tmp/" + id)
 
-	//remove source file
-	storage.FileDelete(input)
+	//remove source file, remote sources are not ours to delete
+	if !IsRemoteSource(input) {
+		storage.FileDelete(input)
+	}
 
 	reportStatus(id, "done")
 	return nil
@@ -0,0 +1,258 @@
+package encoder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mediaSegment is one segment listed in a media playlist
+type mediaSegment struct {
+	File     string
+	Duration float64
+	Size     int64
+}
+
+// rendition is an encoded output, kept around to write the manifests once every rendition is done
+type rendition struct {
+	Profile   SizeMappingType
+	Width     int
+	Height    int
+	FrameRate float64
+	Segments  []mediaSegment
+	// PeakBandwidth and AverageBandwidth are measured from the segments, in bits per second
+	PeakBandwidth    int
+	AverageBandwidth int
+}
+
+// Duration returns the total duration of the rendition in seconds
+func (r rendition) Duration() float64 {
+	total := 0.0
+	for _, segment := range r.Segments {
+		total += segment.Duration
+	}
+	return total
+}
+
+// Bandwidth returns the bitrate in bits per second players should expect for the rendition
+func (r rendition) Bandwidth() int {
+	if r.PeakBandwidth > 0 {
+		return r.PeakBandwidth
+	}
+	return parseBitrate(r.Profile.Maxrate) + parseBitrate(r.Profile.AudioBitrate)
+}
+
+// parseBitrate converts an ffmpeg bitrate like "2500k" to bits per second
+func parseBitrate(bitrate string) int {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(strings.ToLower(bitrate), "k"):
+		multiplier = 1000
+	case strings.HasSuffix(strings.ToLower(bitrate), "m"):
+		multiplier = 1000 * 1000
+	}
+	value, err := strconv.ParseFloat(strings.TrimRight(bitrate, "kKmM"), 64)
+	if err != nil {
+		return 0
+	}
+	return int(value * multiplier)
+}
+
+// parseMediaPlaylist reads the segments from a media playlist written by ffmpeg
+func parseMediaPlaylist(path string) ([]mediaSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segments := []mediaSegment{}
+	var duration float64
+	inSegment := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXTINF:") {
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			inSegment = true
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || !inSegment {
+			continue
+		}
+		segments = append(segments, mediaSegment{File: line, Duration: duration})
+		inSegment = false
+	}
+	return segments, scanner.Err()
+}
+
+// measureRendition collects what the manifests need to know about an encoded rendition in dir:
+// the segments with their sizes, the bitrates they add up to and the real output resolution and frame rate
+func measureRendition(dir string, sm SizeMappingType) (rendition, error) {
+	r := rendition{Profile: sm}
+	segments, err := parseMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return r, err
+	}
+	if len(segments) == 0 {
+		return r, errors.New("media playlist has no segments")
+	}
+
+	var totalBits float64
+	for i, segment := range segments {
+		info, err := os.Stat(filepath.Join(dir, segment.File))
+		if err != nil {
+			return r, err
+		}
+		segments[i].Size = info.Size()
+		bits := float64(info.Size() * 8)
+		totalBits += bits
+		if segment.Duration > 0 {
+			r.PeakBandwidth = max(r.PeakBandwidth, int(math.Ceil(bits/segment.Duration)))
+		}
+	}
+	r.Segments = segments
+	if duration := r.Duration(); duration > 0 {
+		r.AverageBandwidth = int(math.Ceil(totalBits / duration))
+	}
+
+	// segments can't be probed on their own, glue the init segment and the first segment together
+	probePath := filepath.Join(dir, "probe.mp4")
+	if err := concatFiles(probePath, filepath.Join(dir, "init.mp4"), filepath.Join(dir, segments[0].File)); err != nil {
+		return r, err
+	}
+	defer os.Remove(probePath)
+	info, err := probeSource(probePath)
+	if err != nil {
+		return r, fmt.Errorf("failed to probe output: %w", err)
+	}
+	r.Width, r.Height = info.DisplaySize()
+	r.FrameRate = info.FrameRate
+	return r, nil
+}
+
+func concatFiles(dst string, srcs ...string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		in, err := os.Open(src)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// buildMasterPlaylist writes the multivariant playlist following RFC 8216. fMP4 segments need version 7.
+func buildMasterPlaylist(renditions []rendition) (string, error) {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, r := range renditions {
+		attributes := []string{
+			"BANDWIDTH=" + strconv.Itoa(r.Bandwidth()),
+		}
+		if r.AverageBandwidth > 0 {
+			attributes = append(attributes, "AVERAGE-BANDWIDTH="+strconv.Itoa(r.AverageBandwidth))
+		}
+		attributes = append(attributes,
+			fmt.Sprintf("RESOLUTION=%dx%d", r.Width, r.Height),
+			fmt.Sprintf("CODECS=\"%s\"", r.Profile.CodecsAttribute(r.Height, r.FrameRate)),
+		)
+		if r.FrameRate > 0 {
+			attributes = append(attributes, "FRAME-RATE="+strconv.FormatFloat(r.FrameRate, 'f', 3, 64))
+		}
+		playlist.WriteString("#EXT-X-STREAM-INF:" + strings.Join(attributes, ",") + "\n")
+		playlist.WriteString("/" + r.Profile.Label + "\n")
+	}
+
+	if err := validateMasterPlaylist(playlist.String()); err != nil {
+		return "", err
+	}
+	return playlist.String(), nil
+}
+
+var (
+	decimalIntegerPattern    = regexp.MustCompile(`^[0-9]{1,20}$`)
+	decimalResolutionPattern = regexp.MustCompile(`^[0-9]+x[0-9]+$`)
+	decimalFloatPattern      = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	quotedStringPattern      = regexp.MustCompile(`^"[^"\r\n]+"$`)
+	// attribute values may contain commas inside quoted strings
+	attributePattern = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+)
+
+// validateMasterPlaylist checks a multivariant playlist against the parts of RFC 8216 we rely on
+func validateMasterPlaylist(playlist string) error {
+	lines := strings.Split(strings.TrimSuffix(playlist, "\n"), "\n")
+	if len(lines) == 0 || lines[0] != "#EXTM3U" {
+		return errors.New("playlist must start with #EXTM3U")
+	}
+	if !strings.Contains(playlist, "\n#EXT-X-VERSION:7\n") {
+		return errors.New("playlist must declare EXT-X-VERSION 7 for fMP4 segments")
+	}
+
+	variants := 0
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			continue
+		}
+		variants++
+		attributes := map[string]string{}
+		for _, match := range attributePattern.FindAllStringSubmatch(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"), -1) {
+			if _, duplicate := attributes[match[1]]; duplicate {
+				return fmt.Errorf("line %d: duplicate attribute %s", i+1, match[1])
+			}
+			attributes[match[1]] = match[2]
+		}
+
+		bandwidth, ok := attributes["BANDWIDTH"]
+		if !ok || !decimalIntegerPattern.MatchString(bandwidth) || bandwidth == "0" {
+			return fmt.Errorf("line %d: BANDWIDTH must be a positive decimal integer, got %q", i+1, bandwidth)
+		}
+		if average, ok := attributes["AVERAGE-BANDWIDTH"]; ok {
+			if !decimalIntegerPattern.MatchString(average) {
+				return fmt.Errorf("line %d: AVERAGE-BANDWIDTH must be a decimal integer, got %q", i+1, average)
+			}
+			peak, _ := strconv.Atoi(bandwidth)
+			avg, _ := strconv.Atoi(average)
+			if avg > peak {
+				return fmt.Errorf("line %d: AVERAGE-BANDWIDTH exceeds BANDWIDTH", i+1)
+			}
+		}
+		if resolution, ok := attributes["RESOLUTION"]; !ok || !decimalResolutionPattern.MatchString(resolution) || strings.HasPrefix(resolution, "0x") || strings.HasSuffix(resolution, "x0") {
+			return fmt.Errorf("line %d: RESOLUTION must be WIDTHxHEIGHT, got %q", i+1, resolution)
+		}
+		if codecs, ok := attributes["CODECS"]; !ok || !quotedStringPattern.MatchString(codecs) {
+			return fmt.Errorf("line %d: CODECS must be a quoted string, got %q", i+1, codecs)
+		}
+		if frameRate, ok := attributes["FRAME-RATE"]; ok && !decimalFloatPattern.MatchString(frameRate) {
+			return fmt.Errorf("line %d: FRAME-RATE must be a decimal float, got %q", i+1, frameRate)
+		}
+		if i+1 >= len(lines) || lines[i+1] == "" || strings.HasPrefix(lines[i+1], "#") {
+			return fmt.Errorf("line %d: EXT-X-STREAM-INF must be followed by a URI", i+1)
+		}
+	}
+	if variants == 0 {
+		return errors.New("playlist has no variant streams")
+	}
+	return nil
+}
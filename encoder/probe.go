@@ -0,0 +1,162 @@
+package encoder
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// SourceInfo describes the input video as reported by ffprobe
+type SourceInfo struct {
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	FrameRate     float64 `json:"frame_rate"`
+	Duration      float64 `json:"duration"`
+	VideoCodec    string  `json:"video_codec"`
+	AudioCodec    string  `json:"audio_codec,omitempty"`
+	AudioChannels int     `json:"audio_channels,omitempty"`
+	Rotation      int     `json:"rotation"`
+}
+
+var ErrNotAVideo = errors.New("input is not a decodable video")
+
+type probeOutput struct {
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		RFrameRate   string `json:"r_frame_rate"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		Duration     string `json:"duration"`
+		Channels     int    `json:"channels"`
+		Tags         struct {
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// parseFrameRate parses the fractional rates ffprobe reports, e.g. "30000/1001"
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+func probeSource(path string) (SourceInfo, error) {
+	var info SourceInfo
+	out, err := ffmpeg.Probe(path)
+	if err != nil {
+		return info, err
+	}
+	var probe probeOutput
+	if err := json.Unmarshal([]byte(out), &probe); err != nil {
+		return info, err
+	}
+
+	foundVideo := false
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// cover art is reported as a video stream too
+			if foundVideo || stream.Disposition.AttachedPic == 1 || stream.Width == 0 || stream.Height == 0 {
+				continue
+			}
+			foundVideo = true
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.VideoCodec = stream.CodecName
+			info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if info.FrameRate == 0 {
+				info.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+			info.Duration, _ = strconv.ParseFloat(stream.Duration, 64)
+			if rotate, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+				info.Rotation = rotate
+			}
+			for _, sideData := range stream.SideDataList {
+				if sideData.Rotation != 0 {
+					info.Rotation = int(sideData.Rotation)
+				}
+			}
+			info.Rotation = ((info.Rotation % 360) + 360) % 360
+		case "audio":
+			if info.AudioCodec != "" {
+				continue
+			}
+			info.AudioCodec = stream.CodecName
+			info.AudioChannels = stream.Channels
+		}
+	}
+	if !foundVideo {
+		return info, permanent(ErrNotAVideo)
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && duration > 0 {
+		info.Duration = duration
+	}
+	return info, nil
+}
+
+// DisplaySize returns the dimensions after applying rotation, which ffmpeg does automatically when encoding
+func (s SourceInfo) DisplaySize() (int, int) {
+	if s.Rotation == 90 || s.Rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// fitRenditions drops renditions that would be upscaled from the source. If that leaves nothing,
+// the smallest requested rendition is kept but capped to the source resolution.
+func fitRenditions(renditions []SizeMappingType, source SourceInfo) (fitted []SizeMappingType, skipped []string) {
+	sourceW, sourceH := source.DisplaySize()
+	var smallest *SizeMappingType
+	for i, sm := range renditions {
+		w, h := sm.Dimensions()
+		scale := math.Min(float64(w)/float64(sourceW), float64(h)/float64(sourceH))
+		if scale > 1 {
+			skipped = append(skipped, sm.Label)
+			if smallest == nil {
+				smallest = &renditions[i]
+			} else if sw, sh := smallest.Dimensions(); w*h < sw*sh {
+				smallest = &renditions[i]
+			}
+			continue
+		}
+		fitted = append(fitted, sm)
+	}
+	if len(fitted) == 0 && smallest != nil {
+		capped := *smallest
+		capped.Width, capped.Height = sourceW, sourceH
+		fitted = append(fitted, capped)
+		for i, label := range skipped {
+			if label == capped.Label {
+				skipped = append(skipped[:i], skipped[i+1:]...)
+				break
+			}
+		}
+	}
+	return fitted, skipped
+}
@@ -0,0 +1,302 @@
+package encoder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SizeMappingType is an encoding profile, one rendition of the output
+type SizeMappingType struct {
+	Label         string `json:"label" yaml:"label"`
+	Width         int    `json:"width" yaml:"width"`
+	Height        int    `json:"height" yaml:"height"`
+	Codec         string `json:"codec" yaml:"codec"`
+	VideoBitrate  string `json:"video_bitrate" yaml:"video_bitrate"`
+	Maxrate       string `json:"maxrate" yaml:"maxrate"`
+	Bufsize       string `json:"bufsize" yaml:"bufsize"`
+	RateControl   string `json:"rate_control" yaml:"rate_control"`
+	Crf           int    `json:"crf" yaml:"crf"`
+	QP            int    `json:"qp,omitempty" yaml:"qp"`
+	Preset        string `json:"preset" yaml:"preset"`
+	GOP           int    `json:"gop" yaml:"gop"`
+	AudioCodec    string `json:"audio_codec" yaml:"audio_codec"`
+	AudioBitrate  string `json:"audio_bitrate" yaml:"audio_bitrate"`
+	AudioChannels int    `json:"audio_channels,omitempty" yaml:"audio_channels"`
+}
+
+// Rate control modes of a profile
+const (
+	// RateControlTwoPass is a two pass VBR encode targeting VideoBitrate, capped at Maxrate.
+	// Codecs without two pass support do a single pass ABR encode instead.
+	RateControlTwoPass = "2pass"
+	// RateControlCappedCRF is a single pass constant quality encode at Crf, capped at Maxrate/Bufsize
+	RateControlCappedCRF = "capped_crf"
+	// RateControlCQP is a single pass constant quantizer encode at QP
+	RateControlCQP = "cqp"
+)
+
+var rateControlModes = []string{RateControlTwoPass, RateControlCappedCRF, RateControlCQP}
+
+// DefaultSizeMapping is used when no PROFILES_FILE is configured
+var DefaultSizeMapping []SizeMappingType = []SizeMappingType{
+	{Label: "2160p", Width: 3840, Height: 2160, VideoBitrate: "12000k", AudioBitrate: "192k", Bufsize: "18000k", Crf: 18},
+	{Label: "1440p", Width: 2560, Height: 1440, VideoBitrate: "8000k", AudioBitrate: "160k", Bufsize: "12000k", Crf: 19},
+	{Label: "1080p", Width: 1920, Height: 1080, VideoBitrate: "5000k", AudioBitrate: "160k", Bufsize: "8000k", Crf: 20},
+	{Label: "720p", Width: 1280, Height: 720, VideoBitrate: "2500k", AudioBitrate: "128k", Bufsize: "4000k", Crf: 22},
+	{Label: "480p", Width: 854, Height: 480, VideoBitrate: "1200k", AudioBitrate: "96k", Bufsize: "2000k", Crf: 23},
+	{Label: "360p", Width: 640, Height: 360, VideoBitrate: "800k", AudioBitrate: "96k", Bufsize: "1500k", Crf: 24},
+	{Label: "240p", Width: 426, Height: 240, VideoBitrate: "500k", AudioBitrate: "64k", Bufsize: "1000k", Crf: 25},
+	{Label: "144p", Width: 256, Height: 144, VideoBitrate: "300k", AudioBitrate: "64k", Bufsize: "600k", Crf: 26},
+}
+
+// the active profiles, swapped as a whole on reload
+var (
+	sizeMapping     []SizeMappingType
+	sizeMappingLock sync.RWMutex
+)
+
+var labelPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// renditions are served on /data/{label}, next to these routes
+var reservedLabels = []string{"validate", "hls", "dash", "thumbnail", "previews"}
+var bitratePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmM]?$`)
+
+// Dimensions returns the width and height of the box the rendition is scaled into
+func (sm SizeMappingType) Dimensions() (int, int) {
+	return sm.Width, sm.Height
+}
+
+// withDefaults fills in the optional fields of a profile
+func (sm SizeMappingType) withDefaults() SizeMappingType {
+	if sm.Codec == "" {
+		sm.Codec = "libx264"
+	}
+	if sm.RateControl == "" {
+		sm.RateControl = RateControlTwoPass
+	}
+	if sm.Maxrate == "" {
+		sm.Maxrate = sm.VideoBitrate
+	}
+	if codec, ok := videoCodecs[sm.Codec]; ok && sm.Preset == "" {
+		sm.Preset = codec.DefaultPreset
+	}
+	if sm.AudioCodec == "" {
+		sm.AudioCodec = "aac"
+	}
+	return sm
+}
+
+func (sm SizeMappingType) validate() error {
+	if !labelPattern.MatchString(sm.Label) {
+		return errors.New("label may only contain alphanumeric characters, dashes and underscores")
+	}
+	if contains(reservedLabels, sm.Label) {
+		return fmt.Errorf("label %q is reserved, reserved are %v", sm.Label, reservedLabels)
+	}
+	if sm.Width <= 0 || sm.Height <= 0 || sm.Width%2 != 0 || sm.Height%2 != 0 {
+		return errors.New("width and height must be positive even numbers")
+	}
+	codec, ok := videoCodecs[sm.Codec]
+	if !ok {
+		return fmt.Errorf("unsupported codec %q, supported are %v", sm.Codec, codecNames(videoCodecs))
+	}
+	if !contains(codec.Presets, sm.Preset) {
+		return fmt.Errorf("invalid preset %q for %s, valid are %v", sm.Preset, sm.Codec, codec.Presets)
+	}
+	if _, ok := audioCodecs[sm.AudioCodec]; !ok {
+		return fmt.Errorf("unsupported audio codec %q, supported are %v", sm.AudioCodec, codecNames(audioCodecs))
+	}
+	for name, bitrate := range map[string]string{"video_bitrate": sm.VideoBitrate, "maxrate": sm.Maxrate, "bufsize": sm.Bufsize, "audio_bitrate": sm.AudioBitrate} {
+		if !bitratePattern.MatchString(bitrate) {
+			return fmt.Errorf("invalid %s %q", name, bitrate)
+		}
+	}
+	if !contains(rateControlModes, sm.RateControl) {
+		return fmt.Errorf("invalid rate_control %q, valid are %v", sm.RateControl, rateControlModes)
+	}
+	if sm.Crf < 0 || sm.Crf > codec.MaxQuality {
+		return fmt.Errorf("crf must be between 0 and %d for %s", codec.MaxQuality, sm.Codec)
+	}
+	if sm.QP < 0 || sm.QP > codec.MaxQuality {
+		return fmt.Errorf("qp must be between 0 and %d for %s", codec.MaxQuality, sm.Codec)
+	}
+	// 0 is lossless, it has to be asked for with rate_control cqp
+	if sm.RateControl == RateControlCappedCRF && sm.Crf == 0 {
+		return errors.New("crf is required for rate_control capped_crf")
+	}
+	if sm.RateControl == RateControlCQP && sm.QP == 0 {
+		return errors.New("qp is required for rate_control cqp")
+	}
+	if sm.GOP < 0 {
+		return errors.New("gop can not be negative")
+	}
+	if sm.AudioChannels < 0 {
+		return errors.New("audio_channels can not be negative")
+	}
+	return nil
+}
+
+// ValidLabel reports whether label can name a rendition, labels may not clash with the data routes
+func ValidLabel(label string) bool {
+	return labelPattern.MatchString(label) && !contains(reservedLabels, label)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProfiles reads a list of profiles, either as a bare list or under a "profiles" key. The format is picked by file extension.
+func parseProfiles(path string, data []byte) ([]SizeMappingType, error) {
+	var file struct {
+		Profiles []SizeMappingType `json:"profiles" yaml:"profiles"`
+	}
+	var list []SizeMappingType
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.Unmarshal(data, &file); err != nil {
+			if err := json.Unmarshal(data, &list); err != nil {
+				return nil, err
+			}
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			if err := yaml.Unmarshal(data, &list); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("profiles file must be .json, .yaml or .yml")
+	}
+	if list == nil {
+		list = file.Profiles
+	}
+	return list, nil
+}
+
+// ValidateProfiles fills in defaults and checks every profile, returning the profiles ready for use
+func ValidateProfiles(profiles []SizeMappingType) ([]SizeMappingType, error) {
+	if len(profiles) == 0 {
+		return nil, errors.New("no profiles defined")
+	}
+	seen := map[string]bool{}
+	validated := []SizeMappingType{}
+	for i, sm := range profiles {
+		sm = sm.withDefaults()
+		if err := sm.validate(); err != nil {
+			return nil, fmt.Errorf("profile %d (%s): %w", i, sm.Label, err)
+		}
+		if seen[sm.Label] {
+			return nil, fmt.Errorf("profile %d: duplicate label %s", i, sm.Label)
+		}
+		seen[sm.Label] = true
+		validated = append(validated, sm)
+	}
+	return validated, nil
+}
+
+// LoadProfiles reads, validates and activates the profiles in path. The active profiles are left alone on error.
+func LoadProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	profiles, err := parseProfiles(path, data)
+	if err != nil {
+		return err
+	}
+	profiles, err = ValidateProfiles(profiles)
+	if err != nil {
+		return err
+	}
+	sizeMappingLock.Lock()
+	sizeMapping = profiles
+	sizeMappingLock.Unlock()
+	slog.Info("Loaded encoding profiles", "path", path, "count", len(profiles))
+	return nil
+}
+
+// InitProfiles loads PROFILES_FILE, or the default profiles if it is not set, and reloads the file when it changes or on SIGHUP
+func InitProfiles() error {
+	path := os.Getenv("PROFILES_FILE")
+	if path == "" {
+		profiles, err := ValidateProfiles(DefaultSizeMapping)
+		if err != nil {
+			return err
+		}
+		sizeMappingLock.Lock()
+		sizeMapping = profiles
+		sizeMappingLock.Unlock()
+		return nil
+	}
+
+	if err := LoadProfiles(path); err != nil {
+		return err
+	}
+
+	interval, err := time.ParseDuration(os.Getenv("PROFILES_RELOAD_INTERVAL"))
+	if err != nil {
+		interval = 30 * time.Second
+	}
+	go watchProfiles(path, interval)
+	return nil
+}
+
+func watchProfiles(path string, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	for {
+		select {
+		case <-hangup:
+			slog.Info("Received SIGHUP, reloading profiles", "path", path)
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			slog.Info("Profiles file changed, reloading", "path", path)
+		}
+		if err := LoadProfiles(path); err != nil {
+			slog.Error("Failed to reload profiles, keeping the current ones", "path", path, "error", err)
+		}
+	}
+}
+
+// Profiles returns the currently active encoding profiles
+func Profiles() []SizeMappingType {
+	sizeMappingLock.RLock()
+	defer sizeMappingLock.RUnlock()
+	return append([]SizeMappingType{}, sizeMapping...)
+}
+
+func getSizeMapping(size string) SizeMappingType {
+	for _, sm := range Profiles() {
+		if sm.Label == size {
+			return sm
+		}
+	}
+	return SizeMappingType{}
+}
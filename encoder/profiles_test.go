@@ -0,0 +1,65 @@
+package encoder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileValidate(t *testing.T) {
+	valid := SizeMappingType{
+		Label:        "720p",
+		Width:        1280,
+		Height:       720,
+		Codec:        "libx264",
+		VideoBitrate: "2500k",
+		Maxrate:      "2675k",
+		Bufsize:      "4000k",
+		RateControl:  RateControlTwoPass,
+		Crf:          22,
+		Preset:       "slow",
+		AudioCodec:   "aac",
+		AudioBitrate: "128k",
+	}
+	tests := []struct {
+		name    string
+		modify  func(sm *SizeMappingType)
+		wantErr string
+	}{
+		{"valid", func(sm *SizeMappingType) {}, ""},
+		{"invalid label", func(sm *SizeMappingType) { sm.Label = "720 p" }, "label may only contain"},
+		{"reserved label", func(sm *SizeMappingType) { sm.Label = "thumbnail" }, "is reserved"},
+		{"odd width", func(sm *SizeMappingType) { sm.Width = 1281 }, "width and height"},
+		{"zero height", func(sm *SizeMappingType) { sm.Height = 0 }, "width and height"},
+		{"unsupported codec", func(sm *SizeMappingType) { sm.Codec = "mpeg2video" }, "unsupported codec"},
+		{"preset of another codec", func(sm *SizeMappingType) { sm.Preset = "4" }, "invalid preset"},
+		{"numbered preset", func(sm *SizeMappingType) { sm.Codec, sm.Preset = "libsvtav1", "8" }, ""},
+		{"unsupported audio codec", func(sm *SizeMappingType) { sm.AudioCodec = "mp3" }, "unsupported audio codec"},
+		{"invalid bitrate", func(sm *SizeMappingType) { sm.VideoBitrate = "fast" }, "invalid video_bitrate"},
+		{"invalid rate control", func(sm *SizeMappingType) { sm.RateControl = "vbr" }, "invalid rate_control"},
+		{"crf above x264 range", func(sm *SizeMappingType) { sm.Crf = 52 }, "crf must be between 0 and 51"},
+		{"crf in vp9 range", func(sm *SizeMappingType) { sm.Codec, sm.Preset, sm.Crf = "libvpx-vp9", "2", 63 }, ""},
+		{"negative crf", func(sm *SizeMappingType) { sm.Crf = -1 }, "crf must be between"},
+		{"qp above range", func(sm *SizeMappingType) { sm.QP = 64 }, "qp must be between"},
+		{"capped crf without crf", func(sm *SizeMappingType) { sm.RateControl, sm.Crf = RateControlCappedCRF, 0 }, "crf is required"},
+		{"cqp without qp", func(sm *SizeMappingType) { sm.RateControl = RateControlCQP }, "qp is required"},
+		{"cqp", func(sm *SizeMappingType) { sm.RateControl, sm.QP = RateControlCQP, 20 }, ""},
+		{"negative gop", func(sm *SizeMappingType) { sm.GOP = -1 }, "gop can not be negative"},
+		{"negative audio channels", func(sm *SizeMappingType) { sm.AudioChannels = -2 }, "audio_channels can not be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sm := valid
+			test.modify(&sm)
+			err := sm.validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("validate() = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
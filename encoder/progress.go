@@ -0,0 +1,166 @@
+package encoder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// how often progress is written to the queue item
+const progressInterval = 2 * time.Second
+
+// encodeProgress tracks the progress of a job over all of its ffmpeg runs.
+// Every run goes over the whole source, so each run is an equal share of the job.
+type encodeProgress struct {
+	id       string
+	duration float64 // seconds, 0 when the source duration is unknown
+	runs     int
+	done     int
+	reported time.Time
+}
+
+func newEncodeProgress(id string, duration float64, runs int) *encodeProgress {
+	return &encodeProgress{id: id, duration: duration, runs: max(runs, 1)}
+}
+
+// how much of the end of the ffmpeg output is kept for failed runs
+const stderrTailSize = 4096
+
+// FFmpegError is a failed ffmpeg run with the end of what it wrote to stderr
+type FFmpegError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *FFmpegError) Error() string {
+	return "ffmpeg: " + e.Err.Error()
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// stderrTail keeps the last stderrTailSize bytes written to it
+type stderrTail struct {
+	buf []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTailSize {
+		t.buf = t.buf[len(t.buf)-stderrTailSize:]
+	}
+	return len(p), nil
+}
+
+func (t *stderrTail) String() string {
+	return strings.TrimSpace(string(t.buf))
+}
+
+// runFFmpeg runs an ffmpeg command with extra global options, killing ffmpeg when ctx is cancelled
+func runFFmpeg(ctx context.Context, cmd *ffmpeg.Stream, stdout io.Writer, args ...string) error {
+	if stdout != nil {
+		cmd = cmd.WithOutput(stdout)
+	}
+	command := cmd.Compile()
+	// global options are accepted anywhere on the command line
+	command.Args = append(command.Args, args...)
+	tail := &stderrTail{}
+	if command.Stderr != nil {
+		command.Stderr = io.MultiWriter(command.Stderr, tail)
+	} else {
+		command.Stderr = tail
+	}
+	if err := command.Start(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		command.Process.Kill()
+	})
+	err := command.Wait()
+	stop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return &FFmpegError{Err: err, Stderr: tail.String()}
+	}
+	return nil
+}
+
+// run runs an ffmpeg command with -progress piped back, updating the queue item while it runs
+func (p *encodeProgress) run(ctx context.Context, cmd *ffmpeg.Stream) error {
+	reader, writer := io.Pipe()
+	parsed := make(chan struct{})
+	go func() {
+		p.read(reader)
+		close(parsed)
+	}()
+	err := runFFmpeg(ctx, cmd, writer, "-progress", "pipe:1", "-nostats")
+	writer.Close()
+	<-parsed
+	p.done++
+	return err
+}
+
+// read parses the key=value blocks ffmpeg writes with -progress, every block ends with a progress= line
+func (p *encodeProgress) read(reader io.Reader) {
+	var outTime, fps, speed float64
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseFloat(value, 64); err == nil {
+				outTime = us / 1000000
+			}
+		case "fps":
+			fps, _ = strconv.ParseFloat(value, 64)
+		case "speed":
+			speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+		case "progress":
+			if value == "end" || time.Since(p.reported) >= progressInterval {
+				p.report(outTime, fps, speed)
+			}
+		}
+	}
+	// drain whatever is left so ffmpeg never blocks on the pipe
+	io.Copy(io.Discard, reader)
+}
+
+func (p *encodeProgress) report(outTime float64, fps float64, speed float64) {
+	p.reported = time.Now()
+	var percentage float64
+	eta := 0
+	if p.duration > 0 {
+		current := math.Min(outTime/p.duration, 1)
+		percentage = math.Round((float64(p.done)+current)/float64(p.runs)*1000) / 10
+		if speed > 0 {
+			remaining := float64(p.runs-p.done)*p.duration - outTime
+			eta = int(math.Ceil(math.Max(remaining, 0) / speed))
+		}
+	}
+	err := UpdateQueueItem(p.id, func(data *QueueItem) error {
+		if data.Status != Processing || data.WorkerID != WorkerID {
+			return ErrNotClaimed
+		}
+		data.Progress = percentage
+		data.ETA = eta
+		data.FPS = fps
+		data.Speed = speed
+		return nil
+	})
+	if err != nil {
+		slog.Debug("Failed to report progress", "id", p.id, "error", err)
+	}
+}
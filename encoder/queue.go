@@ -3,6 +3,8 @@ package encoder
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"strconv"
@@ -41,54 +43,207 @@ const (
 	Processing Status = "processing"
 	Done       Status = "done"
 	Fail       Status = "fail"
+	Cancelled  Status = "cancelled"
 )
 
 type QueueItem struct {
 	Id       string `json:"id"`
 	Source   string `json:"source"`
 	Profiles string `json:"profiles"`
-	Status   Status `json:"status"`
-	Step     string `json:"step,omitempty"`
-	Attempts int    `json:"attempts"`
-	WorkerID string `json:"worker_id,omitempty"`
+	Queue    string `json:"queue,omitempty"`
+	Priority int    `json:"priority"`
+	// CallbackURL receives the webhooks of this job
+	CallbackURL string `json:"callback_url,omitempty"`
+	Status      Status `json:"status"`
+	Step        string `json:"step,omitempty"`
+	Attempts    int    `json:"attempts"`
+	WorkerID    string `json:"worker_id,omitempty"`
+	// QueuedAt is when the job was added to the queue, StartedAt when its last attempt started and FinishedAt when it
+	// was done, failed or cancelled
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// WaitSeconds is the time from queueing to the first start, EncodeSeconds the time of the last attempt
+	WaitSeconds   float64 `json:"wait_seconds,omitempty"`
+	EncodeSeconds float64 `json:"encode_seconds,omitempty"`
+	// Steps are the steps of the last attempt with the time they started
+	Steps []JobStep `json:"steps,omitempty"`
+	// Progress is the percentage of the encode that is done, ETA the estimated seconds left
+	Progress float64 `json:"progress"`
+	ETA      int     `json:"eta,omitempty"`
+	FPS      float64 `json:"fps,omitempty"`
+	Speed    float64 `json:"speed,omitempty"`
+	// LastError and FailedAt describe the last failed attempt, RetryAt is when a failed job is tried again
+	LastError string     `json:"last_error,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+	// Version is incremented on every update
+	Version int64 `json:"version"`
 }
 
-func StartHeartbeat(ctx context.Context) {
+type JobStep struct {
+	Step string    `json:"step"`
+	At   time.Time `json:"at"`
+}
+
+var (
+	ErrNotClaimed        = errors.New("job is not processed by this worker")
+	ErrQueueItemConflict = errors.New("queue item kept changing, update abandoned")
+	// errSkipUpdate is returned from an update to leave the queue item as it is
+	errSkipUpdate = errors.New("skip update")
+)
+
+// how often an update is retried when the item changed between reading and writing it
+const maxUpdateAttempts = 10
+
+// StartHeartbeat keeps the worker heartbeat, the leases of its claimed jobs and the registration of its queues alive
+func StartHeartbeat(ctx context.Context, queues []workerQueue) {
 	go func() {
 		for {
 			Redis.Set(ctx, "worker:"+WorkerID+":heartbeat", "1", 35*time.Second)
+			renewLeases(ctx)
+			registerQueues(ctx, queues)
 			time.Sleep(10 * time.Second)
 		}
 	}()
 }
 
-func ModifyQueueItem(id string, status Status, attempts int, step string) error {
+// UpdateQueueItem applies update to the stored queue item. The item is watched while update runs and the update is
+// retried from a fresh copy when another writer changed it in the meantime, so update must only depend on the item.
+// Returning errSkipUpdate from update leaves the item unchanged without an error.
+// The change is published and sent to the webhooks once it is written.
+func UpdateQueueItem(id string, update func(data *QueueItem) error) error {
 	ctx := context.Background()
+	key := "queue:" + id
+	var before, after QueueItem
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err := Redis.Watch(ctx, func(tx *redis.Tx) error {
+			item, err := tx.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return ErrJobNotFound
+			}
+			if err != nil {
+				return err
+			}
+			var data QueueItem
+			if err := json.Unmarshal([]byte(item), &data); err != nil {
+				return err
+			}
+			before = data
+			if err := update(&data); err != nil {
+				return err
+			}
+			data.Version++
+			after = data
+			jsonData, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, string(jsonData), 0)
+				indexItem(ctx, pipe, data)
+				return nil
+			})
+			return err
+		}, key)
+		if err == errSkipUpdate {
+			return nil
+		}
+		if err == nil {
+			publishEvent(QueueEventUpdate, after)
+			notifyChange(before, after)
+		}
+		if err != redis.TxFailedErr {
+			return err
+		}
+		// back off a little so concurrent writers don't keep colliding
+		time.Sleep(time.Duration(attempt+1) * 5 * time.Millisecond)
+	}
+	return ErrQueueItemConflict
+}
+
+// GetQueueItem reads a queue item, ErrJobNotFound when it doesn't exist
+func GetQueueItem(ctx context.Context, id string) (QueueItem, error) {
+	var data QueueItem
 	item, err := Redis.Get(ctx, "queue:"+id).Result()
+	if err == redis.Nil {
+		return data, ErrJobNotFound
+	}
 	if err != nil {
-		return err
+		return data, err
 	}
-	var data QueueItem
 	err = json.Unmarshal([]byte(item), &data)
-	if err != nil {
-		return err
+	return data, err
+}
+
+// setStep sets the current step of the job, recording when it started
+func setStep(data *QueueItem, step string) {
+	if step == "" || (step == data.Step && len(data.Steps) > 0) {
+		return
+	}
+	data.Step = step
+	data.Steps = append(data.Steps, JobStep{Step: step, At: time.Now()})
+}
+
+func setStatus(data *QueueItem, status Status, attempts int, step string) {
+	now := time.Now()
+	switch status {
+	case Processing:
+		if data.Status != Processing {
+			// a new attempt
+			data.StartedAt = &now
+			data.FinishedAt = nil
+			data.Steps = nil
+			if data.WaitSeconds == 0 && !data.QueuedAt.IsZero() {
+				data.WaitSeconds = now.Sub(data.QueuedAt).Seconds()
+			}
+		}
+	case Waiting:
+		data.FinishedAt = nil
+	case Fail, Done, Cancelled:
+		data.FinishedAt = &now
+		if data.StartedAt != nil {
+			data.EncodeSeconds = now.Sub(*data.StartedAt).Seconds()
+		}
 	}
 	data.Status = status
 	if attempts > 0 {
 		data.Attempts = attempts
 	}
-	if step != "" {
-		data.Step = step
-	}
+	setStep(data, step)
 	switch status {
 	case Processing:
 		data.WorkerID = WorkerID
-	case Waiting, Fail, Done:
+		data.RetryAt = nil
+	case Waiting, Fail, Done, Cancelled:
 		data.WorkerID = ""
+		data.ETA, data.FPS, data.Speed = 0, 0, 0
 	}
-	jsonData, _ := json.Marshal(data)
-	Redis.Set(ctx, "queue:"+id, string(jsonData), 0)
-	return nil
+	switch status {
+	case Waiting:
+		data.Progress = 0
+	case Done:
+		data.Progress = 100
+	}
+}
+
+func ModifyQueueItem(id string, status Status, attempts int, step string) error {
+	return UpdateQueueItem(id, func(data *QueueItem) error {
+		setStatus(data, status, attempts, step)
+		return nil
+	})
+}
+
+// modifyClaimedQueueItem is ModifyQueueItem for the worker processing the job. It returns ErrNotClaimed
+// instead of overwriting the item when the job was taken away, e.g. requeued after its lease expired.
+func modifyClaimedQueueItem(id string, status Status, attempts int, step string) error {
+	return UpdateQueueItem(id, func(data *QueueItem) error {
+		if data.Status != Processing || data.WorkerID != WorkerID {
+			return ErrNotClaimed
+		}
+		setStatus(data, status, attempts, step)
+		return nil
+	})
 }
 
 func StartTaskProcessor() {
@@ -97,71 +252,102 @@ func StartTaskProcessor() {
 		os.Exit(1)
 	}
 
+	queues, err := workerQueues()
+	if err != nil {
+		slog.Error("Invalid QUEUES", "error", err)
+		os.Exit(1)
+	}
+
 	ctx := context.Background()
 	// Start heartbeat for this worker
 	InitWorkerID()
-	StartHeartbeat(ctx)
+	StartHeartbeat(ctx, queues)
+	migrateLegacyQueue()
 
-	for {
-		slog.Debug("Waiting for next item in queue...")
-		item, err := Redis.BLPop(ctx, 0, "queue:all").Result()
-		if err != nil {
-			continue
-		}
-		if item == nil {
-			continue
-		}
-		id := item[1]
-		// Mark as processing before actual processing
-		err = ModifyQueueItem(id, Processing, 0, "")
-		if err != nil {
-			slog.Error("Failed to set item to processing", "id", id, "error", err)
-			continue
-		}
-		itemData, err := Redis.Get(ctx, "queue:"+id).Result()
-		if err != nil {
-			slog.Error("Failed to get queue item", "error", err)
-			continue
+	// jobs of workers that died are put back in the queue once their lease expires
+	go func() {
+		for {
+			time.Sleep(leaseRecoveryPeriod)
+			RecoverExpiredLeases()
+			migrateLegacyQueue()
 		}
-		var data QueueItem
-		err = json.Unmarshal([]byte(itemData), &data)
-		if err != nil {
-			slog.Error("Failed to get queue item", "error", err)
-			continue
+	}()
+	// failed jobs go back in their queue once their retry is due
+	go func() {
+		for {
+			time.Sleep(delayedPollInterval)
+			promoteDueJobs()
 		}
-		slog.Info("Processing item from queue", "id", data.Id, "source", data.Source, "profiles", data.Profiles, "status", data.Status, "worker_id", WorkerID)
-		err = EncodeFile(data.Source, data.Id, data.Profiles)
+	}()
+
+	slog.Info("Taking jobs from queues", "queues", queues)
+	for {
+		slog.Debug("Waiting for next item in queue...")
+		id, err := claimJob(ctx, queues)
 		if err != nil {
-			slog.Error("Failed to process file", "id", data.Id, "error", err)
-			//if attempts >= 3, set status to fail
-			if data.Attempts >= 3 {
-				err := ModifyQueueItem(data.Id, Fail, data.Attempts+1, "")
-				if err != nil {
-					slog.Error("Failed to modify queue item", "id", data.Id, "error", err)
-					continue
-				}
-			} else {
-				err := ModifyQueueItem(data.Id, Waiting, data.Attempts+1, "")
-				if err != nil {
-					slog.Error("Failed to modify queue item", "id", data.Id, "error", err)
-					continue
-				}
-				// Requeue the item for another attempt
-				Redis.RPush(ctx, "queue:all", data.Id)
-			}
+			slog.Error("Failed to claim job", "error", err)
+			time.Sleep(claimRetryDelay)
 			continue
 		}
-		// Mark as done
-		err = ModifyQueueItem(data.Id, Done, data.Attempts, "")
-		if err != nil {
-			slog.Error("Failed to set item to done", "id", data.Id, "error", err)
-			continue
+		processJob(ctx, id)
+	}
+}
+
+// processJob encodes a claimed job and releases the claim once the job is done, failed, cancelled or requeued
+func processJob(ctx context.Context, id string) {
+	// Mark as processing before actual processing
+	err := UpdateQueueItem(id, func(data *QueueItem) error {
+		if data.Status != Waiting && data.Status != Processing {
+			return fmt.Errorf("job is %s", data.Status)
 		}
+		setStatus(data, Processing, 0, "")
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to set item to processing", "id", id, "error", err)
+		releaseJob(ctx, id)
+		return
+	}
+	data, err := GetQueueItem(ctx, id)
+	if err != nil {
+		slog.Error("Failed to get queue item", "error", err)
+		releaseJob(ctx, id)
+		return
+	}
+	slog.Info("Processing item from queue", "id", data.Id, "source", data.Source, "profiles", data.Profiles, "status", data.Status, "worker_id", WorkerID)
+	jobCtx, cancel := context.WithCancel(ctx)
+	go watchCancel(jobCtx, data.Id, cancel)
+	err = EncodeFile(jobCtx, data.Source, data.Id, data.Profiles, data.CallbackURL)
+	cancelled := err != nil && errors.Is(jobCtx.Err(), context.Canceled)
+	cancel()
+	Redis.Del(ctx, cancelKey(data.Id))
+	if cancelled {
+		slog.Info("Cancelled processing job", "id", data.Id)
+		finishCancelledJob(data)
+		releaseJob(ctx, data.Id)
+		return
+	}
+	if errors.Is(err, ErrEncodeLocked) {
+		// the job didn't fail, another worker is still encoding the video
+		postponeJob(ctx, data, err)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to process file", "id", data.Id, "error", err)
+		failJob(ctx, data, err)
+		return
+	}
+	// Mark as done
+	if err := modifyClaimedQueueItem(data.Id, Done, data.Attempts, ""); err != nil {
+		slog.Error("Failed to set item to done", "id", data.Id, "error", err)
 	}
+	releaseJob(ctx, data.Id)
 }
 
+// RecoverStuckProcessingJobs requeues jobs with an expired lease, and processing jobs of dead workers that never held a lease
 func RecoverStuckProcessingJobs() {
 	slog.Info("Recovering stuck processing jobs")
+	RecoverExpiredLeases()
 	ctx := context.Background()
 	iter := Redis.Scan(ctx, 0, "queue:*", 0).Iterator()
 	for iter.Next(ctx) {
@@ -179,12 +365,28 @@ func RecoverStuckProcessingJobs() {
 			continue
 		}
 		if data.Status == Processing && data.WorkerID != "" {
+			// claimed jobs are recovered through their lease
+			if err := Redis.LPos(ctx, processingKey(data.WorkerID), data.Id, redis.LPosArgs{}).Err(); err != redis.Nil {
+				continue
+			}
 			// Check if worker is alive
 			heartbeat, err := Redis.Get(ctx, "worker:"+data.WorkerID+":heartbeat").Result()
 			if err == redis.Nil || heartbeat == "" {
-				slog.Info("Recovering stuck job", "id", data.Id, "worker_id", data.WorkerID)
-				ModifyQueueItem(data.Id, Waiting, data.Attempts+1, "")
-				Redis.RPush(ctx, "queue:all", data.Id)
+				worker := data.WorkerID
+				err := UpdateQueueItem(data.Id, func(data *QueueItem) error {
+					// the job may have finished or moved on since it was read
+					if data.Status != Processing || data.WorkerID != worker {
+						return errSkipUpdate
+					}
+					setStatus(data, Waiting, data.Attempts+1, "")
+					return nil
+				})
+				if err != nil {
+					slog.Error("Failed to recover stuck job", "id", data.Id, "error", err)
+					continue
+				}
+				slog.Info("Recovering stuck job", "id", data.Id, "worker_id", worker)
+				enqueue(ctx, Redis, data)
 			}
 		}
 	}
@@ -194,6 +396,7 @@ func RecoverStuckProcessingJobs() {
 	slog.Info("Recovery done")
 }
 
+// RemoveCompletedJobs moves all finished jobs from the queue to the history
 func RemoveCompletedJobs() {
 	ctx := context.Background()
 	iter := Redis.Scan(ctx, 0, "queue:*", 0).Iterator()
@@ -213,63 +416,98 @@ func RemoveCompletedJobs() {
 			slog.Error("Failed to unmarshal queue item", "key", key, "error", err)
 			continue
 		}
-		if data.Status == Done {
-			slog.Info("Removing completed job from queue", "id", data.Id)
-			Redis.Del(ctx, key)
+		if data.Status != Done && data.Status != Fail && data.Status != Cancelled {
+			continue
 		}
-		if data.Status == Fail {
-			slog.Info("Removing failed job from queue", "id", data.Id)
-			Redis.Del(ctx, key)
+		// only remove the item when it wasn't changed since it was read, e.g. a failed job that was retried
+		if err := archiveJob(ctx, data, item); err != nil {
+			slog.Info("Job changed, not removing it from the queue", "id", data.Id, "error", err)
+			continue
 		}
-
+		slog.Info("Moved finished job from queue to history", "id", data.Id, "status", data.Status)
 	}
 }
 
-func AddFileToQueue(source string, id string, profiles string) string {
+// AddFileToQueue queues a job, it returns ErrJobActive when a job with the same id is still waiting or processing.
+// When the idempotency key of the options was used before, the job queued with it is returned instead.
+func AddFileToQueue(source string, id string, profiles string, options JobOptions) (string, error) {
 	ctx := context.Background()
 	//push to redis
 	data := QueueItem{
-		Id:       id,
-		Source:   source,
-		Profiles: profiles,
-		Status:   Waiting,
-		Attempts: 0,
+		Id:          id,
+		Source:      source,
+		Profiles:    profiles,
+		Queue:       options.Queue,
+		Priority:    options.Priority,
+		CallbackURL: options.CallbackURL,
+		Status:      Waiting,
+		Attempts:    0,
+		QueuedAt:    time.Now(),
 	}
-	jsonData, _ := json.Marshal(data)
-	// Add to the list for queue order
-	Redis.LPush(ctx, "queue:all", id)
-	// Also set the item by id for direct access
-	Redis.Set(ctx, "queue:"+id, string(jsonData), 0)
-	return id
-}
-
-// array of queue items
-func GetQueue() []QueueItem {
-	ctx := context.Background()
-	var queue []QueueItem
-	// Scan all keys matching queue:*
-	iter := Redis.Scan(ctx, 0, "queue:*", 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-		// Skip the queue:all list key
-		if key == "queue:all" {
-			continue
-		}
-		item, err := Redis.Get(ctx, key).Result()
-		if err != nil {
-			slog.Error("Failed to get queue item", "key", key, "error", err)
-			continue
-		}
-		var data QueueItem
-		err = json.Unmarshal([]byte(item), &data)
-		if err != nil {
-			slog.Error("Failed to unmarshal queue item", "key", key, "error", err)
-			continue
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	keys := []string{"queue:" + id}
+	if options.IdempotencyKey != "" {
+		keys = append(keys, idempotencyKey(options.IdempotencyKey))
+	}
+	replayed := ""
+	// the existing job and the idempotency key are watched, so two submissions can't both queue the job.
+	// When the watch fails the submission is tried again, it then finds the job or the key the other one wrote.
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err = Redis.Watch(ctx, func(tx *redis.Tx) error {
+			if options.IdempotencyKey != "" {
+				existing, err := tx.Get(ctx, idempotencyKey(options.IdempotencyKey)).Result()
+				if err == nil {
+					replayed = existing
+					return nil
+				}
+				if err != redis.Nil {
+					return err
+				}
+			}
+			item, err := tx.Get(ctx, "queue:"+id).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				var existing QueueItem
+				if err := json.Unmarshal([]byte(item), &existing); err != nil {
+					return err
+				}
+				if existing.active() {
+					return ErrJobActive
+				}
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				// Set the item by id for direct access, before a worker can pick it up
+				pipe.Set(ctx, "queue:"+id, string(jsonData), 0)
+				// a cancel flag left over from an earlier job under the id would stop the new one
+				pipe.Del(ctx, cancelKey(id))
+				// and retrying the dead copy of an earlier job would replace it
+				pipe.Del(ctx, deadKey(id))
+				pipe.ZRem(ctx, deadSetKey, id)
+				indexItem(ctx, pipe, data)
+				enqueue(ctx, pipe, data)
+				if options.IdempotencyKey != "" {
+					pipe.Set(ctx, idempotencyKey(options.IdempotencyKey), id, idempotencyTTL)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			break
 		}
-		queue = append(queue, data)
 	}
-	if err := iter.Err(); err != nil {
-		slog.Error("Failed to scan queue keys", "error", err)
+	if err != nil {
+		return "", err
+	}
+	if replayed != "" {
+		return replayed, nil
 	}
-	return queue
+	publishEvent(QueueEventUpdate, data)
+	notify(EventQueued, id, &data, data.CallbackURL)
+	return id, nil
 }
@@ -0,0 +1,206 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Jobs wait in named queues, sorted sets at queues:{name} scored by priority and then by the time they were queued.
+// Every job added to a queue also pushes to the list queues:{name}:ready, which idle workers block on.
+
+const (
+	DefaultQueue = "default"
+	MaxPriority  = 100
+	// DefaultPriority is in the middle, so a job can be queued before or after the jobs without a priority
+	DefaultPriority = MaxPriority / 2
+)
+
+// Workers record the queues they take jobs from in the workers:queues hash, queue name -> unix time in milliseconds
+// a worker was last seen taking from it. Jobs for other queues are rejected, they would wait forever.
+const workerQueuesKey = "workers:queues"
+
+// a queue is still accepted this long after its last worker was seen, so jobs can be queued while workers restart
+const workerQueueTTL = 24 * time.Hour
+
+// JobOptions are the optional settings of a job
+type JobOptions struct {
+	Queue string `json:"queue,omitempty"`
+	// Priority orders the jobs within a queue, higher goes first
+	Priority int `json:"priority,omitempty"`
+	// CallbackURL receives the webhooks of the job, next to WEBHOOK_URLS
+	CallbackURL string `json:"callback_url,omitempty"`
+	// IdempotencyKey makes resubmitting the job return the job queued first
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// Validate checks the options and fills in the default queue. Priority has to be set by the caller, DefaultPriority when none was asked for.
+func (o *JobOptions) Validate() error {
+	if o.Queue == "" {
+		o.Queue = DefaultQueue
+	}
+	if !labelPattern.MatchString(o.Queue) {
+		return errors.New("queue may only contain alphanumeric characters, dashes and underscores")
+	}
+	// the default queue is always accepted, the server can start before its workers
+	if o.Queue != DefaultQueue && !queueConsumed(o.Queue) {
+		return fmt.Errorf("no worker takes jobs from queue %s", o.Queue)
+	}
+	if o.Priority < 0 || o.Priority > MaxPriority {
+		return fmt.Errorf("priority must be between 0 and %d", MaxPriority)
+	}
+	if len(o.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return fmt.Errorf("idempotency key may be at most %d characters", MaxIdempotencyKeyLength)
+	}
+	if o.CallbackURL != "" {
+		return validCallbackURL(o.CallbackURL)
+	}
+	return nil
+}
+
+func queueKey(name string) string {
+	return "queues:" + name
+}
+
+func readyKey(name string) string {
+	return "queues:" + name + ":ready"
+}
+
+// the ready lists are trimmed to this length, notifications for jobs claimed without waiting pile up otherwise
+const readyListSize = 100
+
+// queueScore sorts by priority first and by the time the job was queued second, both fit in the 53 bits of a float64
+func queueScore(priority int, at time.Time) float64 {
+	return float64(MaxPriority-priority)*1e13 + float64(at.UnixMilli())
+}
+
+// queueName is the queue of an item, items queued before named queues existed are in the default queue
+func (q QueueItem) queueName() string {
+	if q.Queue == "" {
+		return DefaultQueue
+	}
+	return q.Queue
+}
+
+// enqueue adds the job to the back of its priority in its queue and wakes up a worker waiting for it
+func enqueue(ctx context.Context, pipe redis.Cmdable, item QueueItem) {
+	pipe.ZAdd(ctx, queueKey(item.queueName()), &redis.Z{Score: queueScore(item.Priority, time.Now()), Member: item.Id})
+	notifyReady(ctx, pipe, item.queueName())
+}
+
+func notifyReady(ctx context.Context, pipe redis.Cmdable, queue string) {
+	pipe.LPush(ctx, readyKey(queue), "1")
+	pipe.LTrim(ctx, readyKey(queue), 0, readyListSize-1)
+}
+
+// queueConsumed reports whether a worker took jobs from the queue recently
+func queueConsumed(name string) bool {
+	seen, err := Redis.HGet(context.Background(), workerQueuesKey, name).Int64()
+	if err == redis.Nil {
+		return false
+	}
+	if err != nil {
+		// don't turn jobs away because the check failed
+		slog.Warn("Failed to check the workers of queue", "queue", name, "error", err)
+		return true
+	}
+	return time.Since(time.UnixMilli(seen)) < workerQueueTTL
+}
+
+// registerQueues records that this worker takes jobs from queues
+func registerQueues(ctx context.Context, queues []workerQueue) {
+	seen := map[string]any{}
+	for _, queue := range queues {
+		seen[queue.Name] = time.Now().UnixMilli()
+	}
+	if err := Redis.HSet(ctx, workerQueuesKey, seen).Err(); err != nil {
+		slog.Warn("Failed to register worker queues", "error", err)
+	}
+}
+
+// workerQueue is a queue this worker takes jobs from
+type workerQueue struct {
+	Name   string
+	Weight float64
+}
+
+// workerQueues parses QUEUES, a comma separated list of queue:weight, e.g. "urgent:10,default:5,bulk:1"
+func workerQueues() ([]workerQueue, error) {
+	value := os.Getenv("QUEUES")
+	if value == "" {
+		return []workerQueue{{Name: DefaultQueue, Weight: 1}}, nil
+	}
+	queues := []workerQueue{}
+	for _, entry := range strings.Split(value, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(entry), ":")
+		queue := workerQueue{Name: name, Weight: 1}
+		if found {
+			parsed, err := strconv.ParseFloat(weight, 64)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid weight %q for queue %s", weight, name)
+			}
+			queue.Weight = parsed
+		}
+		if !labelPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid queue name %q", name)
+		}
+		queues = append(queues, queue)
+	}
+	return queues, nil
+}
+
+// queueOrder picks the order in which the queues are tried for one claim. The order is a weighted random sample,
+// so a queue with weight 10 comes before a queue with weight 1 most of the time without starving the latter.
+func queueOrder(queues []workerQueue) []string {
+	type ranked struct {
+		key  string
+		rank float64
+	}
+	order := []ranked{}
+	for _, queue := range queues {
+		order = append(order, ranked{key: queueKey(queue.Name), rank: math.Pow(rand.Float64(), 1/queue.Weight)})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].rank > order[j].rank
+	})
+	keys := []string{}
+	for _, queue := range order {
+		keys = append(keys, queue.key)
+	}
+	return keys
+}
+
+// legacyQueueScript moves the jobs in the queue:all list of older versions into the default queue, keeping their order
+var legacyQueueScript = redis.NewScript(`
+local moved = 0
+local id = redis.call('LPOP', KEYS[1])
+while id do
+	redis.call('ZADD', KEYS[2], tonumber(ARGV[1]) + moved, id)
+	moved = moved + 1
+	id = redis.call('LPOP', KEYS[1])
+end
+return moved
+`)
+
+func migrateLegacyQueue() {
+	ctx := context.Background()
+	moved, err := legacyQueueScript.Run(ctx, Redis, []string{"queue:all", queueKey(DefaultQueue)}, queueScore(DefaultPriority, time.Now())).Int()
+	if err != nil {
+		slog.Error("Failed to migrate legacy queue", "error", err)
+		return
+	}
+	if moved > 0 {
+		notifyReady(ctx, Redis, DefaultQueue)
+		slog.Info("Moved jobs from the legacy queue to the default queue", "count", moved)
+	}
+}
@@ -0,0 +1,206 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Failed jobs wait in the delayed sorted set, scored by the unix time in milliseconds they are due, until they are promoted back into their queue
+const delayedKey = "delayed"
+
+// how often a worker promotes delayed jobs that are due
+const delayedPollInterval = 1 * time.Second
+
+// retryPolicy decides how often and when failed jobs are retried
+type retryPolicy struct {
+	// MaxAttempts is the number of times a job is tried before it fails for good
+	MaxAttempts int
+	// the n-th retry waits Base * Factor^(n-1), at most Max, give or take Jitter * 100 percent
+	Base   time.Duration
+	Factor float64
+	Jitter float64
+	Max    time.Duration
+}
+
+var retry = retryPolicy{
+	MaxAttempts: 3,
+	Base:        30 * time.Second,
+	Factor:      2,
+	Jitter:      0.2,
+	Max:         time.Hour,
+}
+
+// InitRetryPolicy reads the RETRY_* variables, unset variables keep their default
+func InitRetryPolicy() error {
+	policy := retry
+	if value := os.Getenv("RETRY_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return fmt.Errorf("RETRY_MAX_ATTEMPTS must be a positive number, got %q", value)
+		}
+		policy.MaxAttempts = attempts
+	}
+	for name, duration := range map[string]*time.Duration{"RETRY_BACKOFF_BASE": &policy.Base, "RETRY_BACKOFF_MAX": &policy.Max} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("%s must be a duration like 30s, got %q", name, value)
+			}
+			*duration = parsed
+		}
+	}
+	if value := os.Getenv("RETRY_BACKOFF_FACTOR"); value != "" {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || factor < 1 {
+			return fmt.Errorf("RETRY_BACKOFF_FACTOR must be 1 or more, got %q", value)
+		}
+		policy.Factor = factor
+	}
+	if value := os.Getenv("RETRY_BACKOFF_JITTER"); value != "" {
+		jitter, err := strconv.ParseFloat(value, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return fmt.Errorf("RETRY_BACKOFF_JITTER must be between 0 and 1, got %q", value)
+		}
+		policy.Jitter = jitter
+	}
+	retry = policy
+	return nil
+}
+
+// delay is how long to wait before the n-th retry, counting from 1. The wait is capped at Max after the jitter.
+func (p retryPolicy) delay(n int) time.Duration {
+	delay := float64(p.Base) * math.Pow(p.Factor, float64(n-1))
+	delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(math.Min(delay, float64(p.Max)))
+}
+
+// permanentError marks an error that fails a job for good, trying again would fail the same way
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// permanent marks err so the job is not retried
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// failJob records why a job failed and either schedules a retry or, once out of attempts, fails it for good
+func failJob(ctx context.Context, data QueueItem, jobErr error) {
+	attempts := data.Attempts + 1
+	final := attempts >= retry.MaxAttempts || isPermanent(jobErr)
+	failedAt := time.Now()
+	retryAt := failedAt.Add(retry.delay(attempts))
+
+	var failed QueueItem
+	err := UpdateQueueItem(data.Id, func(item *QueueItem) error {
+		if item.Status != Processing || item.WorkerID != WorkerID {
+			return ErrNotClaimed
+		}
+		if final {
+			setStatus(item, Fail, attempts, "")
+		} else {
+			setStatus(item, Waiting, attempts, "")
+			item.RetryAt = &retryAt
+		}
+		item.LastError = jobErr.Error()
+		item.FailedAt = &failedAt
+		failed = *item
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to modify queue item", "id", data.Id, "error", err)
+		releaseJob(ctx, data.Id)
+		return
+	}
+	if final {
+		slog.Error("Job failed for good", "id", data.Id, "attempts", attempts, "permanent", isPermanent(jobErr))
+		buryJob(ctx, WorkerID, failed, jobErr)
+		return
+	}
+	slog.Info("Retrying job later", "id", data.Id, "attempts", attempts, "retry_at", retryAt)
+	delayJob(ctx, data.Id, retryAt)
+}
+
+// postponeJob parks a job that couldn't start in the delayed set, keeping its attempts and sending no webhook
+func postponeJob(ctx context.Context, data QueueItem, reason error) {
+	retryAt := time.Now().Add(encodeLockedRetryDelay)
+	err := UpdateQueueItem(data.Id, func(item *QueueItem) error {
+		if item.Status != Processing || item.WorkerID != WorkerID {
+			return ErrNotClaimed
+		}
+		setStatus(item, Waiting, 0, "")
+		item.RetryAt = &retryAt
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to modify queue item", "id", data.Id, "error", err)
+		releaseJob(ctx, data.Id)
+		return
+	}
+	slog.Info("Postponing job", "id", data.Id, "reason", reason, "retry_at", retryAt)
+	delayJob(ctx, data.Id, retryAt)
+}
+
+// promoteScript moves a job from the delayed set into its queue, if no other worker promoted it first
+var promoteScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+redis.call('LPUSH', KEYS[3], '1')
+redis.call('LTRIM', KEYS[3], 0, ARGV[3] - 1)
+return 1
+`)
+
+// promoteDueJobs moves delayed jobs whose retry is due back into their queue
+func promoteDueJobs() {
+	ctx := context.Background()
+	now := time.Now()
+	ids, err := Redis.ZRangeByScore(ctx, delayedKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: 100,
+	}).Result()
+	if err != nil {
+		slog.Error("Failed to list delayed jobs", "error", err)
+		return
+	}
+	for _, id := range ids {
+		data, err := GetQueueItem(ctx, id)
+		if err == ErrJobNotFound {
+			Redis.ZRem(ctx, delayedKey, id)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to get queue item", "id", id, "error", err)
+			continue
+		}
+		keys := []string{delayedKey, queueKey(data.queueName()), readyKey(data.queueName())}
+		promoted, err := promoteScript.Run(ctx, Redis, keys, id, queueScore(data.Priority, now), readyListSize).Int()
+		if err != nil {
+			slog.Error("Failed to promote delayed job", "id", id, "error", err)
+			continue
+		}
+		if promoted == 1 {
+			slog.Info("Retry due, queued job again", "id", id, "queue", data.queueName())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package encoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{Base: 30 * time.Second, Factor: 2, Max: time.Hour}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, test := range tests {
+		if got := policy.delay(test.retry); got != test.want {
+			t.Errorf("delay(%d) = %v, want %v", test.retry, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	policy := retryPolicy{Base: 30 * time.Second, Factor: 2, Jitter: 0.2, Max: time.Hour}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 24 * time.Second, 36 * time.Second},
+		{3, 96 * time.Second, 144 * time.Second},
+		// below the cap the jitter applies in full, it can't push the wait past the cap
+		{7, 25*time.Minute + 36*time.Second, 38*time.Minute + 24*time.Second},
+		{10, 48 * time.Minute, time.Hour},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if got := policy.delay(test.retry); got < test.min || got > test.max {
+				t.Fatalf("delay(%d) = %v, want between %v and %v", test.retry, got, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestFailJob(t *testing.T) {
+	WorkerID = "w1"
+	tests := []struct {
+		name       string
+		attempts   int
+		err        error
+		wantStatus Status
+		wantDead   bool
+	}{
+		{"temporary error is retried", 0, errors.New("connection reset"), Waiting, false},
+		{"last attempt", retry.MaxAttempts - 1, errors.New("connection reset"), Fail, true},
+		{"permanent error", 0, permanent(errors.New("invalid size: 9000p")), Fail, true},
+		{"wrapped permanent error", 0, fmt.Errorf("probing: %w", permanent(ErrNotAVideo)), Fail, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRedis(t)
+			ctx := context.Background()
+			item := QueueItem{Id: "job", Status: Processing, WorkerID: "w1", Attempts: test.attempts}
+			storeTestItem(t, item)
+			Redis.RPush(ctx, processingKey("w1"), "job")
+
+			failJob(ctx, item, test.err)
+
+			stored, err := GetQueueItem(ctx, "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != test.wantStatus || stored.Attempts != test.attempts+1 {
+				t.Errorf("item = %s with %d attempts, want %s with %d", stored.Status, stored.Attempts, test.wantStatus, test.attempts+1)
+			}
+			if dead := Redis.Exists(ctx, deadKey("job")).Val() == 1; dead != test.wantDead {
+				t.Errorf("dead = %v, want %v", dead, test.wantDead)
+			}
+			if delayed := Redis.ZScore(ctx, delayedKey, "job").Err() == nil; delayed == test.wantDead {
+				t.Errorf("delayed = %v, want %v", delayed, !test.wantDead)
+			}
+			if Redis.LLen(ctx, processingKey("w1")).Val() != 0 {
+				t.Errorf("claim was kept")
+			}
+		})
+	}
+}
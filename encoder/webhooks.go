@@ -0,0 +1,321 @@
+package encoder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Webhooks are sent to every url in WEBHOOK_URLS and to the callback url of the job.
+// With WEBHOOK_SECRET set the body is signed, X-Goenc-Signature is the hex HMAC-SHA256 of "{X-Goenc-Timestamp}.{body}".
+
+type WebhookEvent string
+
+const (
+	EventQueued    WebhookEvent = "queued"
+	EventStarted   WebhookEvent = "started"
+	EventProgress  WebhookEvent = "progress"
+	EventDone      WebhookEvent = "done"
+	EventFailed    WebhookEvent = "failed"
+	EventCancelled WebhookEvent = "cancelled"
+	EventDeleted   WebhookEvent = "deleted"
+)
+
+// progress events are sent every progressEventStep percent
+const progressEventStep = 10
+
+// a delivery is retried after each of these delays before it is given up
+var webhookRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+// Pending retries wait in the webhooks:retries sorted set, scored by the unix time in milliseconds they are due,
+// so they survive a restart. Any process that sends webhooks delivers the retries that are due.
+const (
+	webhookRetriesKey      = "webhooks:retries"
+	webhookRetryPollPeriod = 1 * time.Second
+	// while an attempt runs its retry is due after the client timeout and this grace period
+	webhookAttemptGrace = 5 * time.Second
+)
+
+// the delivery log keeps the last deliveryLogSize attempts
+const (
+	deliveryLogKey  = "webhooks:deliveries"
+	deliveryLogSize = 500
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type WebhookPayload struct {
+	Id        string       `json:"id"`
+	Event     WebhookEvent `json:"event"`
+	JobId     string       `json:"job_id"`
+	Timestamp time.Time    `json:"timestamp"`
+	Job       *QueueItem   `json:"job,omitempty"`
+}
+
+// pendingWebhook is a webhook for one url, Attempt is the attempt it is delivered with next
+type pendingWebhook struct {
+	Id      string          `json:"id"`
+	Event   WebhookEvent    `json:"event"`
+	JobId   string          `json:"job_id"`
+	URL     string          `json:"url"`
+	Attempt int             `json:"attempt"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// WebhookDelivery is one attempt to deliver a webhook
+type WebhookDelivery struct {
+	Id         string       `json:"id"`
+	Event      WebhookEvent `json:"event"`
+	JobId      string       `json:"job_id"`
+	URL        string       `json:"url"`
+	Attempt    int          `json:"attempt"`
+	StatusCode int          `json:"status_code,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Success    bool         `json:"success"`
+	Time       time.Time    `json:"time"`
+}
+
+// validCallbackURL checks that a callback url is an absolute http(s) url
+func validCallbackURL(callback string) error {
+	parsed, err := url.Parse(callback)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("callback_url must be an http or https url")
+	}
+	return nil
+}
+
+func webhookURLs(callback string) []string {
+	urls := []string{}
+	for _, entry := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			urls = append(urls, entry)
+		}
+	}
+	if callback != "" && !slices.Contains(urls, callback) {
+		urls = append(urls, callback)
+	}
+	return urls
+}
+
+// notifyChange sends the webhook for the change of a queue item, if the change is an event
+func notifyChange(before QueueItem, after QueueItem) {
+	var event WebhookEvent
+	switch {
+	case after.Status == before.Status && after.Status == Processing:
+		if int(after.Progress)/progressEventStep == int(before.Progress)/progressEventStep {
+			return
+		}
+		event = EventProgress
+	case after.Status == before.Status:
+		return
+	case after.Status == Processing:
+		event = EventStarted
+	case after.Status == Done:
+		event = EventDone
+	case after.Status == Fail:
+		event = EventFailed
+	case after.Status == Cancelled:
+		event = EventCancelled
+	default:
+		return
+	}
+	notify(event, after.Id, &after, after.CallbackURL)
+}
+
+// NotifyDeleted sends the deleted webhook for a video
+func NotifyDeleted(id string, callback string) {
+	notify(EventDeleted, id, nil, callback)
+}
+
+// notify sends an event to all webhook urls in the background
+func notify(event WebhookEvent, id string, job *QueueItem, callback string) {
+	urls := webhookURLs(callback)
+	if len(urls) == 0 {
+		return
+	}
+	payload := WebhookPayload{
+		Id:        uuid.New().String(),
+		Event:     event,
+		JobId:     id,
+		Timestamp: time.Now(),
+		Job:       job,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to marshal webhook", "id", id, "event", event, "error", err)
+		return
+	}
+	for _, target := range urls {
+		go deliverWebhook(pendingWebhook{
+			Id:      payload.Id,
+			Event:   payload.Event,
+			JobId:   payload.JobId,
+			URL:     target,
+			Attempt: 1,
+			Body:    body,
+		})
+	}
+}
+
+// deliverWebhook makes one attempt to post a webhook. The next attempt is scheduled before posting, due only once
+// the attempt has certainly timed out, so the webhook is retried even if the process stops during the attempt.
+// It is moved to its retry delay once the attempt failed, and dropped once the attempt succeeded.
+func deliverWebhook(pending pendingWebhook) {
+	ctx := context.Background()
+	retryMember := ""
+	if pending.Attempt <= len(webhookRetryDelays) {
+		next := pending
+		next.Attempt++
+		member, err := json.Marshal(next)
+		if err == nil {
+			due := time.Now().Add(webhookClient.Timeout + webhookAttemptGrace)
+			err = Redis.ZAdd(ctx, webhookRetriesKey, &redis.Z{Score: float64(due.UnixMilli()), Member: string(member)}).Err()
+		}
+		if err != nil {
+			slog.Error("Failed to schedule webhook retry", "url", pending.URL, "event", pending.Event, "id", pending.JobId, "error", err)
+		} else {
+			retryMember = string(member)
+		}
+	}
+
+	delivery := WebhookDelivery{
+		Id:      pending.Id,
+		Event:   pending.Event,
+		JobId:   pending.JobId,
+		URL:     pending.URL,
+		Attempt: pending.Attempt,
+		Time:    time.Now(),
+	}
+	code, err := postWebhook(pending)
+	delivery.StatusCode = code
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.Success = true
+	}
+	logDelivery(delivery)
+	switch {
+	case delivery.Success:
+		if retryMember != "" {
+			Redis.ZRem(ctx, webhookRetriesKey, retryMember)
+		}
+	case pending.Attempt > len(webhookRetryDelays):
+		slog.Error("Giving up on webhook", "url", pending.URL, "event", pending.Event, "id", pending.JobId, "error", err)
+	default:
+		slog.Warn("Failed to deliver webhook, retrying", "url", pending.URL, "event", pending.Event, "id", pending.JobId, "attempt", pending.Attempt, "error", err)
+		if retryMember != "" {
+			due := time.Now().Add(webhookRetryDelays[pending.Attempt-1])
+			// only while the retry is still scheduled, another process may have taken it if the attempt overran
+			Redis.ZAddXX(ctx, webhookRetriesKey, &redis.Z{Score: float64(due.UnixMilli()), Member: retryMember})
+		}
+	}
+}
+
+// postWebhook signs the body with the current time, so retries pass receivers that reject old timestamps
+func postWebhook(pending pendingWebhook) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, pending.URL, bytes.NewReader(pending.Body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "goenc")
+	req.Header.Set("X-Goenc-Event", string(pending.Event))
+	req.Header.Set("X-Goenc-Delivery", pending.Id)
+	req.Header.Set("X-Goenc-Timestamp", timestamp)
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(pending.Body)
+		req.Header.Set("X-Goenc-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("unexpected status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverDueWebhooks delivers the webhook retries that are due, a retry is taken by the process that removes it first
+func deliverDueWebhooks() {
+	ctx := context.Background()
+	members, err := Redis.ZRangeByScore(ctx, webhookRetriesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: 100,
+	}).Result()
+	if err != nil {
+		slog.Error("Failed to list webhook retries", "error", err)
+		return
+	}
+	for _, member := range members {
+		removed, err := Redis.ZRem(ctx, webhookRetriesKey, member).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+		var pending pendingWebhook
+		if err := json.Unmarshal([]byte(member), &pending); err != nil {
+			slog.Error("Dropping invalid webhook retry", "error", err)
+			continue
+		}
+		go deliverWebhook(pending)
+	}
+}
+
+// StartWebhookRetries delivers the webhook retries that are due, run it in every process that sends webhooks
+func StartWebhookRetries() {
+	for {
+		time.Sleep(webhookRetryPollPeriod)
+		deliverDueWebhooks()
+	}
+}
+
+func logDelivery(delivery WebhookDelivery) {
+	ctx := context.Background()
+	jsonData, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+	pipe := Redis.TxPipeline()
+	pipe.LPush(ctx, deliveryLogKey, string(jsonData))
+	pipe.LTrim(ctx, deliveryLogKey, 0, deliveryLogSize-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Failed to log webhook delivery", "id", delivery.Id, "error", err)
+	}
+}
+
+// GetWebhookDeliveries lists the logged delivery attempts, newest first
+func GetWebhookDeliveries() ([]WebhookDelivery, error) {
+	items, err := Redis.LRange(context.Background(), deliveryLogKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	for _, item := range items {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(item), &delivery); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,80 @@
+package encoder
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	tests := []struct {
+		name      string
+		status    int
+		attempt   int
+		wantRetry time.Duration // -1 for no retry left
+	}{
+		{"accepted", http.StatusOK, 1, -1},
+		{"first attempt failed", http.StatusInternalServerError, 1, webhookRetryDelays[0]},
+		{"later attempt failed", http.StatusBadGateway, 3, webhookRetryDelays[2]},
+		{"last attempt failed", http.StatusInternalServerError, len(webhookRetryDelays) + 1, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRedis(t)
+			ctx := context.Background()
+			var inFlight []float64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the retry is held back for as long as the attempt can take
+				inFlight = nil
+				for _, entry := range Redis.ZRangeWithScores(ctx, webhookRetriesKey, 0, -1).Val() {
+					inFlight = append(inFlight, entry.Score)
+				}
+				body, _ := io.ReadAll(r.Body)
+				timestamp, err := strconv.ParseInt(r.Header.Get("X-Goenc-Timestamp"), 10, 64)
+				if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+					t.Errorf("timestamp %q is not the time of the attempt", r.Header.Get("X-Goenc-Timestamp"))
+				}
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write([]byte(r.Header.Get("X-Goenc-Timestamp") + "."))
+				mac.Write(body)
+				if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Goenc-Signature") != want {
+					t.Errorf("signature = %q, want %q", r.Header.Get("X-Goenc-Signature"), want)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			// the due times are stored in milliseconds
+			start := time.Now().Truncate(time.Millisecond)
+			deliverWebhook(pendingWebhook{Id: "d1", Event: EventDone, JobId: "job", URL: server.URL, Attempt: test.attempt, Body: []byte(`{"event":"done"}`)})
+
+			if test.attempt <= len(webhookRetryDelays) {
+				if len(inFlight) != 1 || inFlight[0] < float64(start.Add(webhookClient.Timeout).UnixMilli()) {
+					t.Errorf("retry during the attempt = %v, want due after the client timeout", inFlight)
+				}
+			}
+			retries := Redis.ZRangeWithScores(ctx, webhookRetriesKey, 0, -1).Val()
+			if test.wantRetry < 0 {
+				if len(retries) != 0 {
+					t.Fatalf("retries = %v, want none", retries)
+				}
+				return
+			}
+			if len(retries) != 1 {
+				t.Fatalf("retries = %v, want one", retries)
+			}
+			due := time.UnixMilli(int64(retries[0].Score))
+			if due.Before(start.Add(test.wantRetry)) || due.After(time.Now().Add(test.wantRetry)) {
+				t.Errorf("retry due in %v, want %v", due.Sub(start), test.wantRetry)
+			}
+		})
+	}
+}
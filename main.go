@@ -24,6 +24,10 @@ func InitServer() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
+	encoder.SeedLadders()
+	encoder.BuildQueueIndex()
+	go api.StartTusSweeper()
+
 	api.APIRouter(r)
 	api.VideoDataRouter(r)
 
@@ -56,6 +60,20 @@ func main() {
 	storage.InitStorage()
 	storage.InitLocalStorage() //we always want local storage for storing tmp files
 
+	if err := encoder.InitProfiles(); err != nil {
+		slog.Error("Failed to load encoding profiles", "error", err)
+		os.Exit(1)
+	}
+
+	// every task can requeue jobs, they all count the attempts against the same policy
+	if err := encoder.InitRetryPolicy(); err != nil {
+		slog.Error("Invalid retry settings", "error", err)
+		os.Exit(1)
+	}
+
+	// webhooks are sent by the server and the workers, each process delivers the retries that are due
+	go encoder.StartWebhookRetries()
+
 	workerTasks := strings.Split(os.Getenv("TASKS"), ",")
 	for _, task := range workerTasks {
 		if task == "encode" {
@@ -89,6 +107,34 @@ func main() {
 			}
 
 		}
+		if task == "retention" {
+			if err := encoder.InitRetention(); err != nil {
+				slog.Error("Invalid retention settings", "error", err)
+				os.Exit(1)
+			}
+			s, err := gocron.NewScheduler()
+			if err != nil {
+				slog.Error("Failed to start scheduler", "error", err)
+				os.Exit(1)
+			}
+			job, err := s.NewJob(
+				gocron.CronJob(os.Getenv("RETENTION_CRON"), false),
+				gocron.NewTask(func() {
+					encoder.ApplyRetention()
+				}),
+			)
+			if err != nil {
+				slog.Error("Failed to schedule job", "error", err)
+				os.Exit(1)
+			}
+			s.Start()
+			nextRuns, err := job.NextRuns(5)
+			if err != nil {
+				slog.Error("Failed to get next runs", "error", err)
+			} else {
+				slog.Info("Job retention started", "nextruns", nextRuns)
+			}
+		}
 	}
 
 	slog.Info("Running")
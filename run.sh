@@ -3,8 +3,14 @@
 export JWT_SECRET=secret
 export API_KEY=verysecret
 
-export TASKS=encode,server,stuckrecovery # comma separated list of tasks this worker should do
+export TASKS=encode,server,stuckrecovery,retention # comma separated list of tasks this worker should do
 export STUCKRECOVERY_CRON="0 0 * * *" #cron format for stuck recovery task
+export RETENTION_CRON="0 1 * * *" #cron format for the task moving finished jobs to the history
+# export RETENTION_DAYS=7 # days finished jobs stay in the queue
+# export RETENTION_ITEMS=1000 # finished jobs kept in the queue
+# export HISTORY_ITEMS=10000 # archived jobs kept in the history, 0 keeps all
+# export DEAD_RETENTION_DAYS=30 # days dead jobs are kept for a retry, 0 keeps them until DEAD_ITEMS is reached
+# export DEAD_ITEMS=1000 # dead jobs kept, 0 keeps all
 
 #storage settings
 export STORAGE_MODE=s3 #s3 or local
@@ -19,10 +25,31 @@ export S3_ENDPOINT=http://localhost:9000
 #local storage settings
 export LOCAL_STORAGE_PATH=localdata/
 
+#ingest settings
+# export INGEST_MAX_SIZE=21474836480 # max size in bytes of sources fetched through /api/ingest
+
 #encoding settings
-export ENCODING_RESOLUTIONS="144p,240p,360p,480p,720p,1080p"
+# export PROFILES_FILE=profiles.example.yaml # encoding profiles, the built in defaults are used when unset
+# export PROFILES_RELOAD_INTERVAL=30s # how often the profiles file is checked for changes, SIGHUP reloads it immediately
+# export ENCODE_MODE=combined # separate (default) runs ffmpeg per rendition, combined encodes all renditions from one decode of the source
 # export FFMPEG_HARDWARE_ACCEL=cuda
 
+#queue settings
+# export QUEUES=urgent:10,default:5,bulk:1 # queues this worker takes jobs from with their weight, a higher weight is tried first more often. default is default:1
+# jobs can only be queued in the default queue and in queues a worker took jobs from within the last day. priority goes from 0 to 100, 50 when not set
+
+#retry settings
+# export RETRY_MAX_ATTEMPTS=3 # attempts before a job fails for good
+# export RETRY_BACKOFF_BASE=30s # wait before the first retry
+# export RETRY_BACKOFF_FACTOR=2 # every next retry waits this many times longer
+# export RETRY_BACKOFF_JITTER=0.2 # randomize the wait by up to this fraction
+# export RETRY_BACKOFF_MAX=1h # longest wait between retries
+
+#webhook settings
+# export WEBHOOK_URLS=https://cms.example.com/hooks/goenc # comma separated urls that receive every job event, jobs can add their own callback_url
+# export WEBHOOK_SECRET= # signs webhooks, X-Goenc-Signature is sha256= the HMAC-SHA256 of "{X-Goenc-Timestamp}.{body}", X-Goenc-Timestamp is the time of the attempt
+# failed deliveries are retried after 5s, 30s, 2m and 10m, the retries are kept in redis and survive a restart
+
 #redis settings
 export REDIS_ADDR=localhost:6379
 export REDIS_PASSWORD=
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -9,52 +10,94 @@ import (
 
 var LocalStoragePath string = os.Getenv("LOCAL_STORAGE_PATH")
 
+// LocalBackend stores files on the local filesystem below Root
+type LocalBackend struct {
+	Root string
+}
+
+// Local is the local backend rooted at LocalStoragePath, used for tmp files regardless of STORAGE_MODE
+var Local = &LocalBackend{}
+
+func init() {
+	Register("local", func() (Backend, error) {
+		InitLocalStorage()
+		return Local, nil
+	})
+}
+
 func InitLocalStorage() {
 	if LocalStoragePath == "" {
 		slog.Warn("LOCAL_STORAGE_PATH is not set, defaulting to 'data/'")
 		LocalStoragePath = "data/"
 	}
-	os.Mkdir(os.Getenv("LOCAL_STORAGE_PATH"), 0755)
+	Local.Root = LocalStoragePath
+	os.Mkdir(LocalStoragePath, 0755)
 }
 
-func LocalFileExists(path string) bool {
-	_, err := os.Stat(LocalStoragePath + path)
+func (l *LocalBackend) FileExists(path string) bool {
+	_, err := os.Stat(l.Root + path)
 	return !os.IsNotExist(err)
 }
 
-func LocalFileGet(path string) ([]byte, error) {
-	data, err := os.ReadFile(LocalStoragePath + path)
+func (l *LocalBackend) FileGet(path string, download bool) (GetResult, error) {
+	data, err := os.ReadFile(l.Root + path)
 	if err != nil {
-		return nil, err
+		return GetResult{}, err
 	}
-	return data, nil
+	return GetResult{Data: &data}, nil
 }
 
-func LocalFilePut(path string, data []byte) error {
+func (l *LocalBackend) FilePut(path string, data []byte) error {
 	// create dir if it doesn't exist. get the directory part of the path
-	dir := LocalStoragePath + strings.TrimSuffix(path, "/"+filepath.Base(path))
-	if dir != LocalStoragePath {
+	dir := l.Root + strings.TrimSuffix(path, "/"+filepath.Base(path))
+	if dir != l.Root {
 		os.MkdirAll(dir, 0755)
 	}
 	slog.Debug("Writing local file", "path", path)
-	err := os.WriteFile(LocalStoragePath+path, data, 0644)
+	err := os.WriteFile(l.Root+path, data, 0644)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func LocalDirectoryCreate(path string) error {
-	path = LocalStoragePath + path
+func (l *LocalBackend) Open(path string) (io.ReadCloser, error) {
+	return os.Open(l.Root + path)
+}
+
+func (l *LocalBackend) Create(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(l.Root+path), 0755); err != nil {
+		return nil, err
+	}
+	slog.Debug("Creating local file", "path", path)
+	file, err := os.Create(l.Root + path)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file}, nil
+}
+
+// localWriter removes the partially written file when it is aborted
+type localWriter struct {
+	*os.File
+}
+
+func (w *localWriter) Abort(err error) error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+func (l *LocalBackend) DirectoryCreate(path string) error {
+	path = l.Root + path
 	slog.Debug("Creating local directory", "path", path)
 	return os.MkdirAll(path, 0755)
 }
 
-func LocalDirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
+func (l *LocalBackend) DirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
 	if recursive {
-		return filepath.Glob(LocalStoragePath + path + "/*")
+		return filepath.Glob(l.Root + path + "/*")
 	}
-	files, err := os.ReadDir(LocalStoragePath + path)
+	files, err := os.ReadDir(l.Root + path)
 	if err != nil {
 		return nil, err
 	}
@@ -72,18 +115,58 @@ func LocalDirectoryListing(path string, recursive bool, includeFolders bool) ([]
 	return fileNames, nil
 }
 
-func LocalFileDelete(path string) error {
-	err := os.Remove(LocalStoragePath + path)
+func (l *LocalBackend) FileDelete(path string) error {
+	err := os.Remove(l.Root + path)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func LocalDirectoryDelete(path string) error {
-	err := os.RemoveAll(LocalStoragePath + path)
+func (l *LocalBackend) DirectoryDelete(path string) error {
+	err := os.RemoveAll(l.Root + path)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func LocalFileExists(path string) bool {
+	return Local.FileExists(path)
+}
+
+func LocalFileGet(path string) ([]byte, error) {
+	result, err := Local.FileGet(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return *result.Data, nil
+}
+
+func LocalFilePut(path string, data []byte) error {
+	return Local.FilePut(path, data)
+}
+
+func LocalOpen(path string) (io.ReadCloser, error) {
+	return Local.Open(path)
+}
+
+func LocalCreate(path string) (io.WriteCloser, error) {
+	return Local.Create(path)
+}
+
+func LocalDirectoryCreate(path string) error {
+	return Local.DirectoryCreate(path)
+}
+
+func LocalDirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
+	return Local.DirectoryListing(path, recursive, includeFolders)
+}
+
+func LocalFileDelete(path string) error {
+	return Local.FileDelete(path)
+}
+
+func LocalDirectoryDelete(path string) error {
+	return Local.DirectoryDelete(path)
+}
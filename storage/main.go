@@ -1,38 +1,95 @@
 package storage
 
 import (
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"sort"
 )
 
+// Backend is a place files can be stored in. Paths are always relative to the root of the backend.
+type Backend interface {
+	FileExists(path string) bool
+	FileGet(path string, download bool) (GetResult, error)
+	FilePut(path string, data []byte) error
+	// Open streams a file from the backend. The caller must close the reader.
+	Open(path string) (io.ReadCloser, error)
+	// Create streams a file into the backend. The file is only guaranteed to be stored once Close returned without an error.
+	// A file that can't be written completely must be discarded with Abort instead of Close.
+	Create(path string) (io.WriteCloser, error)
+	FileDelete(path string) error
+	DirectoryCreate(path string) error
+	DirectoryDelete(path string) error
+	DirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error)
+}
+
+// Factory creates a new backend, reading its configuration from the environment
+type Factory func() (Backend, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a backend available under the given name, e.g. for use in STORAGE_MODE
+func Register(name string, factory Factory) {
+	if _, exists := factories[name]; exists {
+		panic("storage backend registered twice: " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	names := []string{}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a new instance of the backend registered under name
+func New(name string) (Backend, error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, errors.New("unknown storage backend: " + name)
+	}
+	return factory()
+}
+
 var storageMode string = os.Getenv("STORAGE_MODE")
 
+// the backend used by the package level functions
+var active Backend
+
 func InitStorage() {
 	if storageMode == "" {
 		storageMode = "local"
 	}
 
-	switch storageMode {
-	case "local":
-		InitLocalStorage()
-	case "s3":
-		InitS3Storage()
-	default:
-		slog.Error("invalid storage mode", "mode", storageMode)
+	backend, err := New(storageMode)
+	if err != nil {
+		slog.Error("invalid storage mode", "mode", storageMode, "available", Backends(), "error", err)
 		os.Exit(1)
 	}
+	active = backend
 }
 
-func FileExists(path string) bool {
-	switch storageMode {
-	case "local":
-		return LocalFileExists(path)
-	case "s3":
-		return S3FileExists(path)
-	default:
-		panic("invalid storage mode")
+// Use replaces the backend used by the package level functions, e.g. to inject a fake in tests
+func Use(backend Backend) {
+	active = backend
+}
+
+// Active returns the backend used by the package level functions
+func Active() Backend {
+	if active == nil {
+		panic("storage is not initialized")
 	}
+	return active
+}
+
+func FileExists(path string) bool {
+	return Active().FileExists(path)
 }
 
 type GetResult struct {
@@ -41,19 +98,7 @@ type GetResult struct {
 }
 
 func FileGet(path string, download bool) (GetResult, error) {
-	switch storageMode {
-	case "local":
-		data, err := LocalFileGet(path)
-		if err != nil {
-			return GetResult{}, err
-		}
-		return GetResult{Data: &data}, nil
-	case "s3":
-		return S3FileGet(path, download)
-
-	default:
-		panic("invalid storage mode")
-	}
+	return Active().FileGet(path, download)
 }
 
 func ServeFile(path string, w http.ResponseWriter, download bool) {
@@ -76,67 +121,69 @@ func ServeFile(path string, w http.ResponseWriter, download bool) {
 }
 
 func FilePut(path string, data []byte) error {
-	switch storageMode {
-	case "local":
-		return LocalFilePut(path, data)
-	case "s3":
-		return S3FilePut(path, data)
-	default:
-		panic("invalid storage mode")
+	return Active().FilePut(path, data)
+}
+
+func Open(path string) (io.ReadCloser, error) {
+	return Active().Open(path)
+}
+
+func Create(path string) (io.WriteCloser, error) {
+	return Active().Create(path)
+}
+
+// Copy streams a file from one backend to another, returning the amount of bytes copied
+func Copy(src Backend, srcPath string, dst Backend, dstPath string) (int64, error) {
+	// creating the destination would truncate the source
+	if src == dst && srcPath == dstPath {
+		return 0, nil
+	}
+	reader, err := src.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	writer, err := dst.Create(dstPath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(writer, reader)
+	if err != nil {
+		Abort(writer, err)
+		return n, err
 	}
+	return n, writer.Close()
 }
 
-func DirectoryCreate(path string) error {
-	switch storageMode {
-	case "local":
-		return LocalDirectoryCreate(path)
-	case "s3":
-		slog.Debug("S3 bucket does not support directory creation", "path", path)
-		return nil
-	default:
-		panic("invalid storage mode")
+// aborter is implemented by the writers of Create that can discard what was written so far
+type aborter interface {
+	Abort(err error) error
+}
+
+// Abort discards a file that is being written with Create, so no partial file is stored. err is the reason it is discarded.
+func Abort(writer io.WriteCloser, err error) error {
+	if err == nil {
+		err = errors.New("write aborted")
+	}
+	if w, ok := writer.(aborter); ok {
+		return w.Abort(err)
 	}
+	return writer.Close()
+}
+
+func DirectoryCreate(path string) error {
+	return Active().DirectoryCreate(path)
 }
 
 func FileDelete(path string) error {
-	switch storageMode {
-	case "local":
-		return LocalFileDelete(path)
-	case "s3":
-		return S3FileDelete(path)
-	default:
-		panic("invalid storage mode")
-	}
+	return Active().FileDelete(path)
 }
 
 func DirectoryDelete(path string) error {
-	switch storageMode {
-	case "local":
-		return LocalDirectoryDelete(path)
-	case "s3":
-		files, err := S3DirectoryListing(path, true, false)
-		if err != nil {
-			return err
-		}
-		for _, file := range files {
-			slog.Debug("Deleting S3 file", "file", file)
-			if err := S3FileDelete(file); err != nil {
-				return err
-			}
-		}
-		return nil
-	default:
-		panic("invalid storage mode")
-	}
+	return Active().DirectoryDelete(path)
 }
 
 func DirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
-	switch storageMode {
-	case "local":
-		return LocalDirectoryListing(path, recursive, includeFolders)
-	case "s3":
-		return S3DirectoryListing(path, recursive, includeFolders)
-	default:
-		panic("invalid storage mode")
-	}
+	return Active().DirectoryListing(path, recursive, includeFolders)
 }
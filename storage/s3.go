@@ -3,31 +3,47 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-var s3Client *s3.Client
+// S3Backend stores files in an S3 compatible bucket
+type S3Backend struct {
+	Client *s3.Client
+	Bucket string
+}
 
-func InitS3Storage() *s3.Client {
+func init() {
+	Register("s3", func() (Backend, error) {
+		return NewS3Backend()
+	})
+}
+
+// NewS3Backend creates a backend from the S3_* environment variables
+func NewS3Backend() (*S3Backend, error) {
 	bucket := os.Getenv("S3_BUCKET")
 	if bucket == "" {
-		panic("S3_BUCKET environment variable is required for S3 storage mode")
+		return nil, errors.New("S3_BUCKET environment variable is required for S3 storage mode")
 	}
 	region := os.Getenv("S3_REGION")
 	if region == "" {
-		panic("S3_REGION environment variable is required for S3 storage mode")
+		return nil, errors.New("S3_REGION environment variable is required for S3 storage mode")
 	}
 
 	keyId := os.Getenv("S3_KEY_ID")
 	keySecret := os.Getenv("S3_KEY_SECRET")
 	if keyId == "" || keySecret == "" {
-		panic("S3_KEY_ID and S3_KEY_SECRET environment variables are required for S3 storage mode")
+		return nil, errors.New("S3_KEY_ID and S3_KEY_SECRET environment variables are required for S3 storage mode")
 	}
 
 	endpoint := os.Getenv("S3_ENDPOINT")
@@ -44,7 +60,7 @@ func InitS3Storage() *s3.Client {
 		),
 	)
 	if err != nil {
-		panic("failed to load AWS config: " + err.Error())
+		return nil, errors.New("failed to load AWS config: " + err.Error())
 	}
 
 	// Create S3 client (supports custom endpoint, e.g. MinIO)
@@ -53,23 +69,22 @@ func InitS3Storage() *s3.Client {
 		o.UsePathStyle = true // fix for localhost / MinIO
 	})
 
-	s3Client = client
-	return s3Client
+	return &S3Backend{Client: client, Bucket: bucket}, nil
 }
 
-func S3FileExists(path string) bool {
-	_, err := s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+func (b *S3Backend) FileExists(path string) bool {
+	_, err := b.Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
 		Key:    aws.String(path),
 	})
 	return err == nil
 }
 
-func S3FileGet(path string, download bool) (GetResult, error) {
+func (b *S3Backend) FileGet(path string, download bool) (GetResult, error) {
 	if download {
 		//download file
-		data, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: aws.String(os.Getenv("S3_BUCKET")),
+		data, err := b.Client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(b.Bucket),
 			Key:    aws.String(path),
 		})
 		if err != nil {
@@ -85,9 +100,9 @@ func S3FileGet(path string, download bool) (GetResult, error) {
 		return GetResult{Data: &bytesData}, nil
 	} else {
 		//generate presigned url
-		presignClient := s3.NewPresignClient(s3Client)
+		presignClient := s3.NewPresignClient(b.Client)
 		presignedReq, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: aws.String(os.Getenv("S3_BUCKET")),
+			Bucket: aws.String(b.Bucket),
 			Key:    aws.String(path),
 		}, func(po *s3.PresignOptions) {
 			po.Expires = time.Second * 10
@@ -99,42 +114,133 @@ func S3FileGet(path string, download bool) (GetResult, error) {
 	}
 }
 
-func S3FilePut(path string, data []byte) error {
-	_, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+func (b *S3Backend) FilePut(path string, data []byte) error {
+	_, err := b.Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(b.Bucket),
 		Key:    aws.String(path),
 		Body:   bytes.NewReader(data),
 	})
 	return err
 }
 
-func S3FileDelete(path string) error {
-	_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+func (b *S3Backend) Open(path string) (io.ReadCloser, error) {
+	data, err := b.Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
 		Key:    aws.String(path),
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return data.Body, nil
+}
+
+// OpenS3Object streams an object from any bucket reachable with the configured S3 credentials, not just the storage bucket.
+// It returns the object size and content type along with the body.
+func OpenS3Object(bucket string, key string) (io.ReadCloser, int64, string, error) {
+	backend, ok := active.(*S3Backend)
+	if !ok {
+		var err error
+		backend, err = NewS3Backend()
+		if err != nil {
+			return nil, 0, "", err
+		}
+	}
+	data, err := backend.Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return data.Body, aws.ToInt64(data.ContentLength), aws.ToString(data.ContentType), nil
+}
+
+// s3Writer feeds a multipart upload running in the background through a pipe
+type s3Writer struct {
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
 }
 
-func S3DirectoryDelete(path string) error {
-	_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+func (w *s3Writer) Close() error {
+	w.pipe.Close()
+	return <-w.done
+}
+
+// Abort fails the upload, so the upload manager doesn't complete it with the truncated data
+func (w *s3Writer) Abort(err error) error {
+	w.pipe.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+func (b *S3Backend) Create(path string) (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	uploader := manager.NewUploader(b.Client)
+	go func() {
+		_, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
+			Bucket: aws.String(b.Bucket),
+			Key:    aws.String(path),
+			Body:   reader,
+		})
+		// unblock any pending writes if the upload failed halfway
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return &s3Writer{pipe: writer, done: done}, nil
+}
+
+func (b *S3Backend) FileDelete(path string) error {
+	_, err := b.Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.Bucket),
 		Key:    aws.String(path),
 	})
 	return err
 }
 
-func S3DirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
+func (b *S3Backend) DirectoryCreate(path string) error {
+	slog.Debug("S3 bucket does not support directory creation", "path", path)
+	return nil
+}
+
+// dirPrefix turns a directory path into a key prefix, without the trailing slash "abc" would also match "abc1/"
+func dirPrefix(path string) string {
+	if path == "" || strings.HasSuffix(path, "/") {
+		return path
+	}
+	return path + "/"
+}
+
+func (b *S3Backend) DirectoryDelete(path string) error {
+	files, err := b.DirectoryListing(path, true, false)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		slog.Debug("Deleting S3 file", "file", file)
+		if err := b.FileDelete(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) DirectoryListing(path string, recursive bool, includeFolders bool) ([]string, error) {
 	var result []string
 	dirSet := make(map[string]struct{})
+	path = dirPrefix(path)
 	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+		Bucket: aws.String(b.Bucket),
 		Prefix: aws.String(path),
 	}
 	if !recursive {
 		input.Delimiter = aws.String("/")
 	}
-	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+	paginator := s3.NewListObjectsV2Paginator(b.Client, input)
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(context.TODO())
 		if err != nil {
@@ -143,13 +249,11 @@ func S3DirectoryListing(path string, recursive bool, includeFolders bool) ([]str
 		// Always add folders from CommonPrefixes if includeFolders is true
 		if includeFolders {
 			for _, prefix := range page.CommonPrefixes {
-				println(*prefix.Prefix)
 				if prefix.Prefix != nil {
 					dir := *prefix.Prefix
 					if _, exists := dirSet[dir]; !exists {
 						dirSet[dir] = struct{}{}
 						result = append(result, dir)
-						println("Added folder:", dir)
 					}
 				}
 			}
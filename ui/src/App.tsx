@@ -23,6 +23,44 @@ async function customFetch(
   return json.data || json;
 }
 
+//EventSource can't send the api key header, so server-sent events are read through fetch
+async function streamEvents<T>(
+  path: string,
+  onEvent: (event: string, data: T) => void,
+  signal: AbortSignal
+) {
+  if (import.meta.env.VITE_API_URL) {
+    path = import.meta.env.VITE_API_URL + path;
+  }
+  const response = await fetch(path, {
+    headers: { "x-api-key": localStorage.getItem("apiKey") || "" },
+    signal,
+  });
+  if (!response.ok || !response.body) {
+    throw new Error("Failed to open event stream");
+  }
+  const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  while (true) {
+    const { value, done } = await reader.read();
+    if (done) return;
+    buffer += value;
+    //events are separated by an empty line
+    let end;
+    while ((end = buffer.indexOf("\n\n")) !== -1) {
+      const block = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+      let event = "message";
+      let data = "";
+      for (const line of block.split("\n")) {
+        if (line.startsWith("event: ")) event = line.slice(7);
+        if (line.startsWith("data: ")) data += line.slice(6);
+      }
+      if (data) onEvent(event, JSON.parse(data));
+    }
+  }
+}
+
 function App() {
   const [apiKey, setApiKey] = useState<string | null>(null);
   const [checkingKey, setCheckingKey] = useState(false);
@@ -100,6 +138,17 @@ function App() {
   return <SignedIn resetAuth={resetAuth} />;
 }
 
+type QueueItem = {
+  id: string;
+  source: string;
+  profiles: string;
+  status: string;
+  step: string;
+  attempts: number;
+  progress: number;
+  eta?: number;
+};
+
 function SignedIn({ resetAuth }: { resetAuth: () => void }) {
   const [videos, setVideos] = useState<
     {
@@ -108,16 +157,7 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
     }[]
   >([]);
 
-  const [queue, setQueue] = useState<
-    {
-      id: string;
-      source: string;
-      profiles: string;
-      status: string;
-      step: string;
-      attempts: number;
-    }[]
-  >([]);
+  const [queue, setQueue] = useState<QueueItem[]>([]);
 
   const [profiles, setProfiles] = useState<string[]>([]);
 
@@ -137,11 +177,36 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
   }, []);
 
   useEffect(() => {
-    //refresh queue every 10 seconds
-    const interval = setInterval(() => {
-      fetchQueue();
-    }, 10000);
-    return () => clearInterval(interval);
+    //keep the queue up to date with the server-sent queue events
+    const controller = new AbortController();
+    async function listen() {
+      while (!controller.signal.aborted) {
+        try {
+          await streamEvents<QueueItem>(
+            "/api/queue/events",
+            (event, item) => {
+              setQueue((queue) => {
+                const others = queue.filter((other) => other.id !== item.id);
+                if (event === "removed") return others;
+                if (others.length === queue.length) return [item, ...queue];
+                return queue.map((other) =>
+                  other.id === item.id ? item : other
+                );
+              });
+            },
+            controller.signal
+          );
+        } catch (e) {
+          if (controller.signal.aborted) return;
+          console.error("Queue event stream failed:", e);
+        }
+        //reconnect after a moment, catching up on anything missed
+        await new Promise((resolve) => setTimeout(resolve, 5000));
+        if (!controller.signal.aborted) fetchQueue();
+      }
+    }
+    listen();
+    return () => controller.abort();
   }, []);
 
   async function fetchVideos() {
@@ -182,7 +247,9 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
   }
 
   async function fetchQueue() {
-    const data = await customFetch("/api/queue", { method: "GET" });
+    const data = await customFetch("/api/queue?order=desc&limit=1000", {
+      method: "GET",
+    });
     setQueue(data);
   }
 
@@ -191,6 +258,11 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
     await fetchQueue();
   }
 
+  async function cancelJob(id: string) {
+    await customFetch(`/api/queue/${id}/cancel`, { method: "POST" });
+    await fetchQueue();
+  }
+
   async function cleanupJobs() {
     await customFetch("/api/queue/cleanup", { method: "POST" });
     await fetchQueue();
@@ -203,7 +275,7 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
 
   async function fetchProfiles() {
     const data = await customFetch("/api/profiles", { method: "GET" });
-    setProfiles(data);
+    setProfiles(data.map((profile: { label: string }) => profile.label));
   }
 
   return (
@@ -404,6 +476,27 @@ function SignedIn({ resetAuth }: { resetAuth: () => void }) {
                   <div className="mt-2 md:mt-0 text-sm text-yellow-800">
                     <span className="font-semibold">{video.status}</span> (
                     {video.step}, {video.attempts} attempts)
+                    {video.status === "processing" && (
+                      <span className="ml-2">
+                        {video.progress.toFixed(1)}%
+                        {video.eta ? `, ${Math.ceil(video.eta / 60)} min left` : ""}
+                      </span>
+                    )}
+                    {(video.status === "waiting" ||
+                      video.status === "processing") && (
+                      <button
+                        className="ml-2 px-2 rounded-md bg-red-500 text-white hover:bg-red-700 font-semibold transition"
+                        onClick={() => {
+                          if (
+                            !confirm("Are you sure you want to cancel this job?")
+                          )
+                            return;
+                          cancelJob(video.id);
+                        }}
+                      >
+                        Cancel
+                      </button>
+                    )}
                   </div>
                 </div>
               ))}